@@ -0,0 +1,226 @@
+package knowdy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+)
+
+// GetScript returns a script of the current snapshot.
+func (s *Shard) GetScript(id string) (Script, error) {
+	script, ok := s.Cache().Scripts[id]
+	if !ok {
+		return Script{}, ErrNotFound
+	}
+	return script, nil
+}
+
+// PutScript creates or replaces a script. With create set an existing
+// script with the same id is an error.
+func (s *Shard) PutScript(script Script, create bool) error {
+	return s.editScripts(func(scripts map[string]Script, langCaches []LangCache) ([]LangCache, error) {
+		if _, ok := scripts[script.Id]; ok && create {
+			return nil, ErrExists
+		}
+		if _, ok := scripts[script.Id]; !ok && !create {
+			return nil, ErrNotFound
+		}
+		scripts[script.Id] = script
+		return langCaches, nil
+	})
+}
+
+// DeleteScript removes a script; validation refuses it while reactions
+// still refer to the script.
+func (s *Shard) DeleteScript(id string) error {
+	return s.editScripts(func(scripts map[string]Script, langCaches []LangCache) ([]LangCache, error) {
+		if _, ok := scripts[id]; !ok {
+			return nil, ErrNotFound
+		}
+		delete(scripts, id)
+		return langCaches, nil
+	})
+}
+
+// GetReactions lists the reactions of a script context in a language.
+func (s *Shard) GetReactions(lang string, ctxId string) ([]ScriptReact, error) {
+	for _, lc := range s.Cache().LangCaches {
+		if lc.Id != lang {
+			continue
+		}
+		for _, ctx := range lc.ScriptCtxs {
+			if ctx.Id == ctxId {
+				return ctx.ScriptReacts, nil
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// GetReaction returns a single reaction of a script context.
+func (s *Shard) GetReaction(lang string, ctxId string, id string) (ScriptReact, error) {
+	reacts, err := s.GetReactions(lang, ctxId)
+	if err != nil {
+		return ScriptReact{}, err
+	}
+	for _, react := range reacts {
+		if react.Id == id {
+			return react, nil
+		}
+	}
+	return ScriptReact{}, ErrNotFound
+}
+
+// PutReaction creates or replaces a reaction, adding the language and
+// the context on first use.
+func (s *Shard) PutReaction(lang string, ctxId string, react ScriptReact, create bool) error {
+	return s.editReactions(lang, ctxId, func(reacts []ScriptReact) ([]ScriptReact, error) {
+		for i := range reacts {
+			if reacts[i].Id != react.Id {
+				continue
+			}
+			if create {
+				return nil, ErrExists
+			}
+			reacts[i] = react
+			return reacts, nil
+		}
+		if !create {
+			return nil, ErrNotFound
+		}
+		return append(reacts, react), nil
+	})
+}
+
+// DeleteReaction removes a reaction from a script context.
+func (s *Shard) DeleteReaction(lang string, ctxId string, id string) error {
+	return s.editReactions(lang, ctxId, func(reacts []ScriptReact) ([]ScriptReact, error) {
+		for i := range reacts {
+			if reacts[i].Id == id {
+				return append(reacts[:i], reacts[i+1:]...), nil
+			}
+		}
+		return nil, ErrNotFound
+	})
+}
+
+func (s *Shard) editReactions(lang string, ctxId string, fn func([]ScriptReact) ([]ScriptReact, error)) error {
+	return s.editScripts(func(scripts map[string]Script, langCaches []LangCache) ([]LangCache, error) {
+		li := -1
+		for i := range langCaches {
+			if langCaches[i].Id == lang {
+				li = i
+				break
+			}
+		}
+		if li == -1 {
+			langCaches = append(langCaches, LangCache{Id: lang})
+			li = len(langCaches) - 1
+		}
+		lc := &langCaches[li]
+		lc.ScriptCtxs = append([]ScriptCtx(nil), lc.ScriptCtxs...)
+
+		ci := -1
+		for i := range lc.ScriptCtxs {
+			if lc.ScriptCtxs[i].Id == ctxId {
+				ci = i
+				break
+			}
+		}
+		if ci == -1 {
+			lc.ScriptCtxs = append(lc.ScriptCtxs, ScriptCtx{Id: ctxId})
+			ci = len(lc.ScriptCtxs) - 1
+		}
+		ctx := &lc.ScriptCtxs[ci]
+
+		reacts, err := fn(append([]ScriptReact(nil), ctx.ScriptReacts...))
+		if err != nil {
+			return nil, err
+		}
+		ctx.ScriptReacts = reacts
+		return langCaches, nil
+	})
+}
+
+// editScripts applies fn to private copies of the scripts and the reactions,
+// validates the outcome, persists both cache files and only then publishes
+// the new snapshot.
+func (s *Shard) editScripts(fn func(map[string]Script, []LangCache) ([]LangCache, error)) error {
+	defer s.DecodeCache.Purge()
+	return s.updateCache(func(c *ScriptCache) error {
+		scripts := make(map[string]Script, len(c.Scripts)+1)
+		for k, v := range c.Scripts {
+			scripts[k] = v
+		}
+		langCaches, err := fn(scripts, append([]LangCache(nil), c.LangCaches...))
+		if err != nil {
+			return err
+		}
+		if err := ValidateScripts(scripts, langCaches, s.defaultLang()); err != nil {
+			return err
+		}
+		if err := s.saveScriptCache(scripts, langCaches); err != nil {
+			return err
+		}
+		c.Scripts = scripts
+		c.LangCaches = langCaches
+		c.MsgIdx = buildMsgIdx(langCaches)
+		c.reindexGeo()
+		return nil
+	})
+}
+
+// saveScriptCache is called with cacheMu held. Both files are written to
+// temporary files first; if the second rename fails the first file is
+// restored, so the pair on disk never mixes two edits.
+func (s *Shard) saveScriptCache(scripts map[string]Script, langCaches []LangCache) error {
+	if s.scriptCachePath == "" || s.msgCachePath == "" {
+		return errors.New("script cache files are not configured")
+	}
+	scriptData, err := json.MarshalIndent(scripts, "", "  ")
+	if err != nil {
+		return err
+	}
+	msgData, err := json.MarshalIndent(langCaches, "", "  ")
+	if err != nil {
+		return err
+	}
+	scriptTmp, err := stageFile(s.scriptCachePath, scriptData)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(scriptTmp)
+	msgTmp, err := stageFile(s.msgCachePath, msgData)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(msgTmp)
+
+	// a fresh deployment has no script cache yet: roll back by removing it
+	prev, err := ioutil.ReadFile(s.scriptCachePath)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not keep the script cache for a rollback: %w", err)
+	}
+	if err := os.Rename(scriptTmp, s.scriptCachePath); err != nil {
+		return err
+	}
+	if err := os.Rename(msgTmp, s.msgCachePath); err != nil {
+		rerr := os.Remove(s.scriptCachePath)
+		if existed {
+			rerr = writeFileAtomic(s.scriptCachePath, prev)
+		}
+		if rerr != nil {
+			return fmt.Errorf("%v; script cache rollback failed: %w", err, rerr)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package knowdy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestShard(t *testing.T) (*Shard, string, string) {
+	scripts, msgs := writeTestCaches(t)
+	s := &Shard{}
+	if err := s.PopulateScriptCache(scripts); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PopulateMsgCache(msgs); err != nil {
+		t.Fatal(err)
+	}
+	return s, scripts, msgs
+}
+
+func TestValidateScripts(t *testing.T) {
+	scripts := map[string]Script{
+		"greet": {Id: "greet", ScriptPhases: map[string]ScriptPhase{
+			"init": {Body: map[string]string{"ru": "Привет"}},
+		}},
+	}
+	langCaches := []LangCache{{Id: "en", ScriptCtxs: []ScriptCtx{{Id: "main", ScriptReacts: []ScriptReact{
+		{Id: "greet", Triggers: []string{"hi"}},
+		{Id: "missing", Triggers: []string{"!!"}},
+	}}}}}
+
+	err := ValidateScripts(scripts, langCaches, "en")
+	var problems ValidationErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("expected validation errors, got %v", err)
+	}
+	want := []string{
+		"langcaches[0].ctxs[0].scripts[1].id",
+		"langcaches[0].ctxs[0].scripts[1].triggers[0]",
+		"scripts.greet.phases.init.body.en",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("got %v", problems)
+	}
+	for i, p := range problems {
+		if p.Path != want[i] {
+			t.Errorf("problem %d: got path %q, want %q", i, p.Path, want[i])
+		}
+	}
+}
+
+func TestPopulateScriptCacheReportsPosition(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dbcache.json")
+	data := "{\n  \"greet\": {\"id\": 42}\n}"
+	if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var s Shard
+	err := s.PopulateScriptCache(filename)
+	if err == nil {
+		t.Fatal("expected a decoding error")
+	}
+	if !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), "id") {
+		t.Errorf("error does not point at the problem: %v", err)
+	}
+}
+
+func TestPutScriptPersists(t *testing.T) {
+	s, scripts, msgs := loadTestShard(t)
+
+	script := Script{Id: "bye", ScriptPhases: map[string]ScriptPhase{
+		"init": {Body: map[string]string{"en": "Bye"}},
+	}}
+	if err := s.PutScript(script, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutScript(script, true); !errors.Is(err, ErrExists) {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+	if err := s.PutReaction("en", "main", ScriptReact{Id: "bye", Triggers: []string{"bye"}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &Shard{}
+	if err := reloaded.PopulateScriptCache(scripts); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.PopulateMsgCache(msgs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.GetScript("bye"); err != nil {
+		t.Error(err)
+	}
+	if _, err := reloaded.CacheLookup(nil, "main", "Bye!", []string{"en"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEditRejectsInvalid(t *testing.T) {
+	s, scripts, _ := loadTestShard(t)
+	before, err := ioutil.ReadFile(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.PutReaction("en", "main", ScriptReact{Id: "nope", Triggers: []string{"x"}}, true)
+	var problems ValidationErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("expected validation errors, got %v", err)
+	}
+	if err := s.DeleteScript("greet"); !errors.As(err, &problems) {
+		t.Errorf("deleting a referenced script: got %v", err)
+	}
+	if err := s.DeleteReaction("en", "main", "nope"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	after, err := ioutil.ReadFile(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Error("rejected edit was persisted")
+	}
+	if _, err := s.GetReaction("en", "main", "nope"); !errors.Is(err, ErrNotFound) {
+		t.Error("rejected edit was published")
+	}
+}
+
+func TestSaveRollsBack(t *testing.T) {
+	s, scripts, msgs := loadTestShard(t)
+	before, err := ioutil.ReadFile(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a directory in place of the message cache makes the second rename fail
+	s.msgCachePath = filepath.Join(filepath.Dir(msgs), "msgs.d")
+	if err := os.Mkdir(s.msgCachePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	script := Script{Id: "bye", ScriptPhases: map[string]ScriptPhase{
+		"init": {Body: map[string]string{"en": "Bye"}},
+	}}
+	if err := s.PutScript(script, true); err == nil {
+		t.Fatal("expected the save to fail")
+	}
+	after, err := ioutil.ReadFile(scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Error("script cache was not rolled back")
+	}
+	if _, err := s.GetScript("bye"); !errors.Is(err, ErrNotFound) {
+		t.Error("failed edit was published")
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(scripts), ".*")); len(leftovers) > 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+}
+
+func TestSaveWithoutCacheFiles(t *testing.T) {
+	dir := t.TempDir()
+	scripts, msgs := filepath.Join(dir, "dbcache.json"), filepath.Join(dir, "msgcache.json")
+	s := &Shard{}
+	if err := s.PopulateScriptCache(scripts); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PopulateMsgCache(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	script := Script{Id: "bye", ScriptPhases: map[string]ScriptPhase{
+		"init": {Body: map[string]string{"en": "Bye"}},
+	}}
+	if err := s.PutScript(script, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{scripts, msgs} {
+		if _, err := os.Stat(filename); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// a failed save leaves no script cache behind when there was none
+	if err := os.Remove(scripts); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(msgs); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(msgs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	script.Id = "later"
+	if err := s.PutScript(script, true); err == nil {
+		t.Fatal("expected the save to fail")
+	}
+	if _, err := os.Stat(scripts); !os.IsNotExist(err) {
+		t.Errorf("script cache was not rolled back: %v", err)
+	}
+}
+
+func TestDeleteReaction(t *testing.T) {
+	s, _, _ := loadTestShard(t)
+	if err := s.DeleteReaction("ru", "main", "greet"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CacheLookup(nil, "main", "привет", []string{"ru"}); err == nil {
+		t.Error("deleted reaction still fires")
+	}
+	if _, err := s.CacheLookup(nil, "main", "hello", []string{"en"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,64 @@
+package knowdy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreaker fails calls fast after maxFailures consecutive failures.
+// Once cooldown has passed a single trial call is let through: success
+// closes the breaker, failure opens it for another cooldown.
+type circuitBreaker struct {
+	maxFailures int
+	cooldown    time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+	now      func() time.Time
+}
+
+func newCircuitBreaker(maxFailures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{maxFailures: maxFailures, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a call may proceed; every allowed call must be
+// followed by done.
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < cb.maxFailures {
+		return nil
+	}
+	if cb.trial || cb.now().Sub(cb.openedAt) < cb.cooldown {
+		return ErrCircuitOpen
+	}
+	cb.trial = true
+	return nil
+}
+
+func (cb *circuitBreaker) done(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.trial = false
+	if success {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.failures >= cb.maxFailures {
+		cb.openedAt = cb.now()
+	}
+}
+
+func (cb *circuitBreaker) open() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.failures >= cb.maxFailures
+}
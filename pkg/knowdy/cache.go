@@ -0,0 +1,169 @@
+package knowdy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// ScriptCache is an immutable snapshot of the scripted reactions.
+// Readers get it via Shard.Cache and never lock; writers build a new
+// snapshot and publish it atomically, so a snapshot must not be
+// modified once it has been stored.
+type ScriptCache struct {
+	Scripts    map[string]Script
+	LangCaches []LangCache
+	MsgIdx     map[string]MsgIdx // keyed by base language
+
+	GeoIdx *GeoIndex // script geotags
+}
+
+// MsgIdx maps normalized triggers of a single language to their interps.
+type MsgIdx map[string][]MsgInterp
+
+var emptyCache = &ScriptCache{
+	Scripts: map[string]Script{},
+	MsgIdx:  map[string]MsgIdx{},
+}
+
+// Cache returns the current snapshot of the script cache.
+func (s *Shard) Cache() *ScriptCache {
+	c, ok := s.cache.Load().(*ScriptCache)
+	if !ok {
+		return emptyCache
+	}
+	return c
+}
+
+// updateCache serializes writers: fn receives a shallow copy of the
+// current snapshot and replaces whatever fields it changes.
+func (s *Shard) updateCache(fn func(c *ScriptCache) error) error {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	c := *s.Cache()
+	if err := fn(&c); err != nil {
+		return err
+	}
+	s.cache.Store(&c)
+	return nil
+}
+
+func (s *Shard) PopulateScriptCache(Filename string) error {
+	s.cacheMu.Lock()
+	s.scriptCachePath = Filename
+	s.cacheMu.Unlock()
+
+	CacheBytes, err := ioutil.ReadFile(Filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read json db cache: %w", err)
+	}
+	var scripts map[string]Script
+	err = decodeJSON(CacheBytes, &scripts)
+	if err != nil {
+		return fmt.Errorf("failed to read json script db cache %s: %w", Filename, err)
+	}
+	defer s.DecodeCache.Purge()
+	return s.updateCache(func(c *ScriptCache) error {
+		c.Scripts = scripts
+		c.reindexGeo()
+		logValidation(c, s.defaultLang())
+		return nil
+	})
+}
+
+func (s *Shard) PopulateMsgCache(Filename string) error {
+	s.cacheMu.Lock()
+	s.msgCachePath = Filename
+	s.cacheMu.Unlock()
+
+	CacheBytes, err := ioutil.ReadFile(Filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read json msg cache: %w", err)
+	}
+
+	var langCaches []LangCache
+	err = decodeJSON(CacheBytes, &langCaches)
+	if err != nil {
+		return fmt.Errorf("failed to parse json msg cache %s: %w", Filename, err)
+	}
+
+	defer s.DecodeCache.Purge()
+	return s.updateCache(func(c *ScriptCache) error {
+		c.LangCaches = langCaches
+		c.MsgIdx = buildMsgIdx(langCaches)
+		logValidation(c, s.defaultLang())
+		return nil
+	})
+}
+
+// logValidation reports problems in hand-authored cache files without
+// refusing to load them; edits made through the admin API are strict.
+func logValidation(c *ScriptCache, defaultLang string) {
+	if c.Scripts == nil || c.LangCaches == nil {
+		return
+	}
+	if err := ValidateScripts(c.Scripts, c.LangCaches, defaultLang); err != nil {
+		for _, e := range err.(ValidationErrors) {
+			log.Println("-- script cache:", e.Error())
+		}
+	}
+}
+
+func buildMsgIdx(langCaches []LangCache) map[string]MsgIdx {
+	idx := make(map[string]MsgIdx)
+	for _, lc := range langCaches {
+		for _, ctx := range lc.ScriptCtxs {
+			for _, react := range ctx.ScriptReacts {
+				for _, trig := range react.Triggers {
+					registerMsg(idx, lc.Id, trig, react, ctx)
+				}
+			}
+		}
+	}
+	return idx
+}
+
+// RegisterMsg adds a single trigger to the live message index.
+func (s *Shard) RegisterMsg(lang string, msg string, react ScriptReact, ctx ScriptCtx) error {
+	return s.updateCache(func(c *ScriptCache) error {
+		idx := make(map[string]MsgIdx, len(c.MsgIdx)+1)
+		for k, v := range c.MsgIdx {
+			idx[k] = v
+		}
+		// copy the partition being written to, the rest stays shared
+		lang = baseLang(lang)
+		langIdx := make(MsgIdx, len(idx[lang])+1)
+		for k, v := range idx[lang] {
+			langIdx[k] = v
+		}
+		idx[lang] = langIdx
+		registerMsg(idx, lang, msg, react, ctx)
+		c.MsgIdx = idx
+		return nil
+	})
+}
+
+func registerMsg(idx map[string]MsgIdx, lang string, msg string, react ScriptReact, ctx ScriptCtx) {
+	key := NormalizeMsg(msg, lang)
+	if key == "" {
+		return
+	}
+	lang = baseLang(lang)
+	langIdx, is_present := idx[lang]
+	if !is_present {
+		langIdx = make(MsgIdx)
+		idx[lang] = langIdx
+	}
+	interps := langIdx[key]
+	interp := MsgInterp{&ctx, &react}
+	// never append in place: the old slice may be shared with a published snapshot
+	langIdx[key] = append(interps[:len(interps):len(interps)], interp)
+}
@@ -0,0 +1,149 @@
+package knowdy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/globbie/aide/pkg/session"
+)
+
+const testScriptCache = `{
+	"greet": {"id": "greet", "phases": {"init": {"body": {"en": "Hi there"}}}}
+}`
+
+const testMsgCache = `[
+	{"id": "en", "ctxs": [
+		{"id": "main", "scripts": [{"id": "greet", "triggers": ["hello", "hi"]}]}
+	]},
+	{"id": "ru", "ctxs": [
+		{"id": "main", "scripts": [{"id": "greet", "triggers": ["привет"]}]}
+	]}
+]`
+
+func writeTestCaches(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	scripts := filepath.Join(dir, "dbcache.json")
+	msgs := filepath.Join(dir, "msgcache.json")
+	if err := ioutil.WriteFile(scripts, []byte(testScriptCache), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(msgs, []byte(testMsgCache), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return scripts, msgs
+}
+
+func TestCacheLookup(t *testing.T) {
+	scripts, msgs := writeTestCaches(t)
+	var s Shard
+	if err := s.PopulateScriptCache(scripts); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PopulateMsgCache(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	ses := &session.ChatSession{}
+	if _, err := s.CacheLookup(ses, "main", " Hello ", []string{"en"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.CacheLookup(ses, "main", "bye", []string{"en"}); err == nil {
+		t.Error("expected a cache miss")
+	}
+	if _, err := s.CacheLookup(ses, "other", "hello", []string{"en"}); err == nil {
+		t.Error("expected no interp for a foreign ctx")
+	}
+}
+
+func TestCacheLookupLangChain(t *testing.T) {
+	scripts, msgs := writeTestCaches(t)
+	var s Shard
+	if err := s.PopulateScriptCache(scripts); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PopulateMsgCache(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	ses := &session.ChatSession{}
+	if _, err := s.CacheLookup(ses, "main", "привет", []string{"en"}); err == nil {
+		t.Error("a Russian trigger fired for an English session")
+	}
+	reply, err := s.CacheLookup(ses, "main", "Привет!", []string{"ru", "en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(reply, `"lang":"ru"`) {
+		t.Errorf("expected a Russian reply, got %s", reply)
+	}
+	reply, err = s.CacheLookup(ses, "main", "hello", []string{"ru", "en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(reply, `"lang":"en"`) {
+		t.Errorf("expected an English fallback reply, got %s", reply)
+	}
+}
+
+func TestCacheLookupEmpty(t *testing.T) {
+	var s Shard
+	if _, err := s.CacheLookup(&session.ChatSession{}, "main", "hello", []string{"en"}); err == nil {
+		t.Error("expected a cache miss on an empty shard")
+	}
+}
+
+func TestCacheConcurrentReload(t *testing.T) {
+	scripts, msgs := writeTestCaches(t)
+	var s Shard
+	if err := s.PopulateScriptCache(scripts); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PopulateMsgCache(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	const readers = 8
+	const iterations = 200
+
+	var wg sync.WaitGroup
+	errs := make(chan error, readers*iterations)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ses := &session.ChatSession{}
+			for j := 0; j < iterations; j++ {
+				if _, err := s.CacheLookup(ses, "main", "hi", []string{"en"}); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		react := ScriptReact{Id: "greet"}
+		ctx := ScriptCtx{Id: "main"}
+		for j := 0; j < iterations; j++ {
+			if err := s.PopulateScriptCache(scripts); err != nil {
+				errs <- err
+			}
+			if err := s.PopulateMsgCache(msgs); err != nil {
+				errs <- err
+			}
+			if err := s.RegisterMsg("en", "hey", react, ctx); err != nil {
+				errs <- err
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
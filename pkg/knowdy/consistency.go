@@ -0,0 +1,98 @@
+package knowdy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/globbie/aide/pkg/session"
+)
+
+var (
+	// ReadYourWritesWindow is how long reads of a user who committed go to
+	// the authority rather than to the local shard, which only sees the
+	// commit once it has synced.
+	ReadYourWritesWindow = 30 * time.Second
+	// AuthorityReadTimeout bounds a read from the authority before the
+	// local shard answers instead.
+	AuthorityReadTimeout = 3 * time.Second
+)
+
+// maxClockSkew tolerates replicas whose clocks are ahead of ours.
+const maxClockSkew = 5 * time.Second
+
+// CommittedRecently reports whether a commit made at the given time may
+// not have synced to the local shard yet.
+func CommittedRecently(at time.Time) bool {
+	if at.IsZero() {
+		return false
+	}
+	age := time.Since(at)
+	return age > -maxClockSkew && age < ReadYourWritesWindow
+}
+
+// ReadTask runs a read-only task on the local shard, unless the session
+// has just committed: then the authority answers so that the user sees
+// their own writes. The local shard is the fallback when the authority
+// is not reachable.
+func (s *Shard) ReadTask(ctx context.Context, ses *session.ChatSession, task string) (string, error) {
+	if ses != nil && CommittedRecently(ses.LastCommit) {
+		reply, err := s.runRemoteTask(ctx, s.authority(), task)
+		if err == nil {
+			return reply, nil
+		}
+		log.Println("-- authority read failed, falling back to the local shard:", err)
+	}
+	reply, _, err := s.RunTask(task, len(task))
+	return reply, err
+}
+
+// readClient reads from the authority directly: no proxy and no
+// redirects, a short timeout and a few kept-alive connections.
+var readClient = &http.Client{
+	Timeout: AuthorityReadTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   2 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        8,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (s *Shard) runRemoteTask(ctx context.Context, address string, task string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, AuthorityReadTimeout)
+	defer cancel()
+
+	u := url.URL{Scheme: "http", Host: address, Path: "/gsl"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewBufferString(task))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := readClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s replied %d: %s", address, resp.StatusCode, body)
+	}
+	return string(body), nil
+}
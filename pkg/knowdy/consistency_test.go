@@ -0,0 +1,74 @@
+package knowdy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/globbie/aide/pkg/session"
+)
+
+func TestCommittedRecently(t *testing.T) {
+	now := time.Now()
+	if !CommittedRecently(now) || !CommittedRecently(now.Add(time.Second)) {
+		t.Error("a fresh commit is recent")
+	}
+	if CommittedRecently(time.Time{}) || CommittedRecently(now.Add(-ReadYourWritesWindow)) {
+		t.Error("the write should have aged out")
+	}
+	if CommittedRecently(now.Add(time.Hour)) {
+		t.Error("a marker from the future is bogus")
+	}
+}
+
+func TestReadTaskAfterWrite(t *testing.T) {
+	var task string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		task = string(b)
+		_, _ = io.WriteString(w, `{"name":"Banana"}`)
+	}))
+	defer ts.Close()
+
+	s := Shard{KnowdyAddress: ts.URL[7:]}
+	ses := &session.ChatSession{UserId: "u1", LastCommit: time.Now()}
+
+	q := QueryTask("{class Banana}", "en", "JSON")
+	reply, err := s.ReadTask(context.Background(), ses, q)
+	if err != nil || reply != `{"name":"Banana"}` {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	if task != q {
+		t.Errorf("authority got %q, want %q", task, q)
+	}
+}
+
+func TestRemoteTaskBounded(t *testing.T) {
+	saved := AuthorityReadTimeout
+	AuthorityReadTimeout = 50 * time.Millisecond
+	defer func() { AuthorityReadTimeout = saved }()
+
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+	s := Shard{}
+	start := time.Now()
+	if _, err := s.runRemoteTask(context.Background(), stalled.Listener.Addr().String(), "{task}"); err == nil {
+		t.Error("expected a stalled authority to time out")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the read took %v", d)
+	}
+
+	redirect := httptest.NewServer(http.RedirectHandler("http://example.com/gsl", http.StatusTemporaryRedirect))
+	defer redirect.Close()
+	if _, err := s.runRemoteTask(context.Background(), redirect.Listener.Addr().String(), "{task}"); err == nil {
+		t.Error("a redirect must not be followed")
+	}
+}
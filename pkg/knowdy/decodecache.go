@@ -0,0 +1,185 @@
+package knowdy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaults of ShardOptions.DecodeCacheSize and DecodeCacheTTL
+var (
+	DecodeCacheSize = 4096
+	DecodeCacheTTL  = 10 * time.Minute
+)
+
+type decodeKey struct {
+	text string // trimmed, punctuation kept: "Banana?" is not "Banana."
+	lang string
+}
+
+func newDecodeKey(text string, lang string) decodeKey {
+	return decodeKey{strings.Join(strings.Fields(text), " "), lang}
+}
+
+// decodeResult is what ProcessMsg needs from the ling processor and
+// the engine for an utterance.
+type decodeResult struct {
+	graph     string
+	discourse string
+	interp    string
+}
+
+type decodeEntry struct {
+	key     decodeKey
+	result  decodeResult
+	expires time.Time
+}
+
+// DecodeCache is an LRU cache with a TTL in front of DecodeText and BuildJSON.
+type DecodeCache struct {
+	// 64-bit counters first to keep them aligned for atomic access
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[decodeKey]*list.Element
+	gen   uint64 // bumped by Purge
+}
+
+// DecodeCacheStats are the cumulative counters of a DecodeCache.
+type DecodeCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+}
+
+func NewDecodeCache(maxEntries int, ttl time.Duration) *DecodeCache {
+	return &DecodeCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		now:        time.Now,
+		ll:         list.New(),
+		items:      make(map[decodeKey]*list.Element),
+	}
+}
+
+func (c *DecodeCache) get(key decodeKey) (decodeResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return decodeResult{}, false
+	}
+	entry := el.Value.(*decodeEntry)
+	if c.now().After(entry.expires) {
+		c.removeElement(el)
+		atomic.AddUint64(&c.misses, 1)
+		return decodeResult{}, false
+	}
+	c.ll.MoveToFront(el)
+	atomic.AddUint64(&c.hits, 1)
+	return entry.result, true
+}
+
+// generation is taken before a decode starts and handed to add, so that
+// a result computed before a Purge is not cached after it.
+func (c *DecodeCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+func (c *DecodeCache) add(key decodeKey, result decodeResult, gen uint64) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		entry := el.Value.(*decodeEntry)
+		entry.result, entry.expires = result, expires
+		return
+	}
+	c.items[key] = c.ll.PushFront(&decodeEntry{key, result, expires})
+	for c.ll.Len() > c.maxEntries {
+		c.removeElement(c.ll.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+func (c *DecodeCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*decodeEntry).key)
+}
+
+// Purge drops every entry, e.g. after the schemas or scripts were reloaded.
+func (c *DecodeCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[decodeKey]*list.Element)
+	c.gen++
+}
+
+func (c *DecodeCache) Stats() DecodeCacheStats {
+	c.mu.Lock()
+	size := c.ll.Len()
+	c.mu.Unlock()
+	return DecodeCacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Size:      size,
+	}
+}
+
+// decode runs the text through the ling processor and the engine unless
+// the same utterance was seen recently.
+func (s *Shard) decode(ctx context.Context, text string, lang string) (decodeResult, error) {
+	key := newDecodeKey(text, lang)
+	var gen uint64
+	if s.DecodeCache != nil {
+		if result, ok := s.DecodeCache.get(key); ok {
+			return result, nil
+		}
+		gen = s.DecodeCache.generation()
+	}
+
+	var result decodeResult
+	var err error
+	result.graph, result.discourse, err = s.DecodeText(ctx, text, lang)
+	if err != nil {
+		return result, errors.New("text decoding failed :: " + err.Error())
+	}
+	result.interp, err = s.BuildJSON(result.graph, lang)
+	if err != nil {
+		return result, errors.New("JSON encoding failed :: " + err.Error())
+	}
+
+	if s.DecodeCache != nil {
+		s.DecodeCache.add(key, result, gen)
+	}
+	return result, nil
+}
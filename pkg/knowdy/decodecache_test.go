@@ -0,0 +1,114 @@
+package knowdy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeCacheEviction(t *testing.T) {
+	c := NewDecodeCache(2, time.Minute)
+	a, b, d := decodeKey{"a", "en"}, decodeKey{"b", "en"}, decodeKey{"d", "en"}
+
+	c.add(a, decodeResult{graph: "A"}, 0)
+	c.add(b, decodeResult{graph: "B"}, 0)
+	if _, ok := c.get(a); !ok { // a becomes the most recent
+		t.Fatal("expected a hit for a")
+	}
+	c.add(d, decodeResult{graph: "D"}, 0)
+
+	if _, ok := c.get(b); ok {
+		t.Error("b should have been evicted")
+	}
+	if r, ok := c.get(a); !ok || r.graph != "A" {
+		t.Errorf("got %v %v, want A", r, ok)
+	}
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Evictions != 1 || stats.Size != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDecodeCacheTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewDecodeCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	key := decodeKey{"hello", "en"}
+	c.add(key, decodeResult{graph: "G"}, 0)
+	now = now.Add(30 * time.Second)
+	if _, ok := c.get(key); !ok {
+		t.Fatal("entry expired too early")
+	}
+	now = now.Add(time.Minute)
+	if _, ok := c.get(key); ok {
+		t.Fatal("entry should have expired")
+	}
+	if size := c.Stats().Size; size != 0 {
+		t.Errorf("expired entry kept, size %d", size)
+	}
+}
+
+func TestDecodeCacheLangs(t *testing.T) {
+	c := NewDecodeCache(10, time.Minute)
+	c.add(decodeKey{"kettle", "en"}, decodeResult{graph: "en"}, 0)
+	if _, ok := c.get(decodeKey{"kettle", "ru"}); ok {
+		t.Error("entries must not be shared between languages")
+	}
+}
+
+func TestDecodeCachePurgedOnReload(t *testing.T) {
+	s, scripts, msgs := loadTestShard(t)
+	s.DecodeCache = NewDecodeCache(10, time.Minute)
+	key := decodeKey{"hello", "en"}
+
+	s.DecodeCache.add(key, decodeResult{graph: "G"}, s.DecodeCache.generation())
+	if err := s.PopulateMsgCache(msgs); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.DecodeCache.get(key); ok {
+		t.Error("message cache reload should purge decode results")
+	}
+
+	s.DecodeCache.add(key, decodeResult{graph: "G"}, s.DecodeCache.generation())
+	if err := s.PopulateScriptCache(scripts); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.DecodeCache.get(key); ok {
+		t.Error("script cache reload should purge decode results")
+	}
+}
+
+func TestDecodeCacheDisabled(t *testing.T) {
+	c := NewDecodeCache(0, time.Minute)
+	c.add(decodeKey{"a", "en"}, decodeResult{}, 0)
+	if _, ok := c.get(decodeKey{"a", "en"}); ok {
+		t.Error("a zero-sized cache should keep nothing")
+	}
+	var nilCache *DecodeCache
+	nilCache.Purge()
+}
+
+func TestDecodeKeyPunctuation(t *testing.T) {
+	if newDecodeKey("Banana?", "en") == newDecodeKey("Banana.", "en") {
+		t.Error("a question and a statement must not share an entry")
+	}
+	if newDecodeKey("  Banana?\n", "en") != newDecodeKey("Banana?", "en") {
+		t.Error("surrounding spaces should not matter")
+	}
+}
+
+func TestDecodeCacheStaleAdd(t *testing.T) {
+	c := NewDecodeCache(10, time.Minute)
+	key := decodeKey{"hello", "en"}
+
+	gen := c.generation() // a decode starts
+	c.Purge()             // the scripts are reloaded meanwhile
+	c.add(key, decodeResult{graph: "stale"}, gen)
+	if _, ok := c.get(key); ok {
+		t.Error("a result decoded before a purge must not be cached")
+	}
+	c.add(key, decodeResult{graph: "G"}, c.generation())
+	if _, ok := c.get(key); !ok {
+		t.Error("expected a hit")
+	}
+}
@@ -0,0 +1,337 @@
+package knowdy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"golang.org/x/text/language"
+)
+
+const (
+	earthRadiusKm = 6371.0
+	kmPerDegree   = 2 * math.Pi * earthRadiusKm / 360
+	geoCellDeg    = 0.1 // ~11 km cells
+	geoCols       = int(360 / geoCellDeg)
+)
+
+var (
+	// NearbyRadiusKm and NearbyLimit bound the geotags attached to replies
+	// when the session has a location.
+	NearbyRadiusKm = 2.0
+	NearbyLimit    = 5
+
+	// MaxEngineGeoTags bounds the geotags kept from engine results; the
+	// oldest are dropped first.
+	MaxEngineGeoTags = 10000
+)
+
+type geoCell struct{ x, y int }
+
+// GeoIndex is an immutable grid index over geotags.
+type GeoIndex struct {
+	cells map[geoCell][]GeoTag
+	size  int
+}
+
+// GeoHit is a geotag found around a point along with its distance.
+type GeoHit struct {
+	GeoTag
+	Distance float64 `json:"distance"` // km
+}
+
+func cellOf(lat, lng float64) geoCell {
+	x := int(math.Floor((lng + 180) / geoCellDeg))
+	y := int(math.Floor((lat + 90) / geoCellDeg))
+	return geoCell{((x % geoCols) + geoCols) % geoCols, y}
+}
+
+// NewGeoIndex indexes the tags; a later tag replaces an earlier one with
+// the same non-empty id.
+func NewGeoIndex(tags []GeoTag) *GeoIndex {
+	byId := make(map[string]int)
+	var uniq []GeoTag
+	for _, tag := range tags {
+		if tag.Id != "" {
+			if i, ok := byId[tag.Id]; ok {
+				uniq[i] = tag
+				continue
+			}
+			byId[tag.Id] = len(uniq)
+		}
+		uniq = append(uniq, tag)
+	}
+
+	idx := GeoIndex{cells: make(map[geoCell][]GeoTag), size: len(uniq)}
+	for _, tag := range uniq {
+		c := cellOf(tag.Lat, tag.Lng)
+		idx.cells[c] = append(idx.cells[c], tag)
+	}
+	return &idx
+}
+
+func (idx *GeoIndex) Len() int {
+	if idx == nil {
+		return 0
+	}
+	return idx.size
+}
+
+// Nearby returns up to limit tags within radiusKm of the point, closest first.
+func (idx *GeoIndex) Nearby(lat, lng, radiusKm float64, limit int) []GeoHit {
+	if idx == nil || idx.size == 0 || limit <= 0 {
+		return nil
+	}
+	var hits []GeoHit
+	forCells(lat, lng, radiusKm, func(c geoCell) {
+		for _, tag := range idx.cells[c] {
+			if d := haversine(lat, lng, tag.Lat, tag.Lng); d <= radiusKm {
+				hits = append(hits, GeoHit{tag, d})
+			}
+		}
+	})
+	return closest(hits, limit)
+}
+
+// forCells calls fn for every grid cell that may hold a point within
+// radiusKm of lat/lng.
+func forCells(lat, lng, radiusKm float64, fn func(geoCell)) {
+	dLat := radiusKm / kmPerDegree
+	dLng := 360.0
+	if cos := math.Cos(lat * math.Pi / 180); cos > 0.01 {
+		dLng = dLat / cos
+	}
+
+	lo, hi := cellOf(lat-dLat, lng), cellOf(lat+dLat, lng)
+	x0 := int(math.Floor((lng - dLng + 180) / geoCellDeg))
+	x1 := int(math.Floor((lng + dLng + 180) / geoCellDeg))
+	if x1-x0 >= geoCols {
+		x0, x1 = 0, geoCols-1
+	}
+	for y := lo.y; y <= hi.y; y++ {
+		for x := x0; x <= x1; x++ {
+			fn(geoCell{((x % geoCols) + geoCols) % geoCols, y})
+		}
+	}
+}
+
+func closest(hits []GeoHit, limit int) []GeoHit {
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Distance < hits[j].Distance })
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// engineGeoIndex holds the geotags seen in public engine results. Unlike
+// the script index it changes with every query, so it is updated in place
+// under its own lock instead of being rebuilt into a new cache snapshot.
+type engineGeoIndex struct {
+	mu    sync.RWMutex
+	tags  map[string]GeoTag
+	cells map[geoCell]map[string]GeoTag
+	order []string // keys, oldest first
+}
+
+func geoTagKey(tag GeoTag) string {
+	if tag.Id != "" {
+		return tag.Id
+	}
+	return fmt.Sprintf("%f,%f", tag.Lat, tag.Lng)
+}
+
+// add replaces the tags with the same key and evicts the oldest ones
+// beyond MaxEngineGeoTags.
+func (e *engineGeoIndex) add(tags []GeoTag) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.tags == nil {
+		e.tags = make(map[string]GeoTag)
+		e.cells = make(map[geoCell]map[string]GeoTag)
+	}
+	for _, tag := range tags {
+		key := geoTagKey(tag)
+		if _, ok := e.tags[key]; ok {
+			e.unlink(key)
+		} else {
+			for len(e.tags) >= MaxEngineGeoTags && len(e.order) > 0 {
+				e.unlink(e.order[0])
+				delete(e.tags, e.order[0])
+				e.order = e.order[1:]
+			}
+			if MaxEngineGeoTags <= 0 {
+				return
+			}
+			e.order = append(e.order, key)
+		}
+		e.tags[key] = tag
+		c := cellOf(tag.Lat, tag.Lng)
+		if e.cells[c] == nil {
+			e.cells[c] = make(map[string]GeoTag)
+		}
+		e.cells[c][key] = tag
+	}
+}
+
+// unlink removes a tag from its grid cell.
+func (e *engineGeoIndex) unlink(key string) {
+	tag := e.tags[key]
+	c := cellOf(tag.Lat, tag.Lng)
+	delete(e.cells[c], key)
+	if len(e.cells[c]) == 0 {
+		delete(e.cells, c)
+	}
+}
+
+func (e *engineGeoIndex) nearby(lat, lng, radiusKm float64, limit int) []GeoHit {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if len(e.tags) == 0 || limit <= 0 {
+		return nil
+	}
+	var hits []GeoHit
+	forCells(lat, lng, radiusKm, func(c geoCell) {
+		for _, tag := range e.cells[c] {
+			if d := haversine(lat, lng, tag.Lat, tag.Lng); d <= radiusKm {
+				hits = append(hits, GeoHit{tag, d})
+			}
+		}
+	})
+	return closest(hits, limit)
+}
+
+func (e *engineGeoIndex) len() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.tags)
+}
+
+func haversine(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// scriptGeoTags collects the geotags of every script phase.
+func scriptGeoTags(scripts map[string]Script) []GeoTag {
+	var tags []GeoTag
+	for _, script := range scripts {
+		for _, phase := range script.ScriptPhases {
+			tags = append(tags, phase.GeoTags...)
+		}
+	}
+	return tags
+}
+
+// mergeGeoTags appends the hits missing from tags into a fresh slice.
+func mergeGeoTags(tags []GeoTag, hits []GeoHit) []GeoTag {
+	if len(hits) == 0 {
+		return tags
+	}
+	out := append([]GeoTag(nil), tags...)
+	for _, hit := range hits {
+		dup := false
+		for _, tag := range tags {
+			if hit.Id != "" && tag.Id == hit.Id {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			out = append(out, hit.GeoTag)
+		}
+	}
+	return out
+}
+
+// reindexGeo rebuilds the spatial index of a snapshot under construction.
+func (c *ScriptCache) reindexGeo() {
+	c.GeoIdx = NewGeoIndex(scriptGeoTags(c.Scripts))
+}
+
+// IndexGeoTags adds geotags found in engine results to the spatial index.
+// The index is served to anyone by NearbyGeoTags, so only results that
+// are public may be indexed.
+func (s *Shard) IndexGeoTags(tags []GeoTag) {
+	if len(tags) == 0 {
+		return
+	}
+	s.engineGeo.add(tags)
+}
+
+// nearbyGeoTags searches the script geotags and the engine ones; a script
+// tag wins over an engine tag with the same id.
+func (s *Shard) nearbyGeoTags(lat, lng, radiusKm float64, limit int) []GeoHit {
+	hits := s.Cache().GeoIdx.Nearby(lat, lng, radiusKm, limit)
+	seen := make(map[string]bool, len(hits))
+	for _, hit := range hits {
+		if hit.Id != "" {
+			seen[hit.Id] = true
+		}
+	}
+	for _, hit := range s.engineGeo.nearby(lat, lng, radiusKm, limit) {
+		if hit.Id == "" || !seen[hit.Id] {
+			hits = append(hits, hit)
+		}
+	}
+	return closest(hits, limit)
+}
+
+// NearbyGeoTags searches the spatial index and localizes the titles found.
+func (s *Shard) NearbyGeoTags(lat, lng, radiusKm float64, limit int, prefs []language.Tag) []GeoHit {
+	hits := s.nearbyGeoTags(lat, lng, radiusKm, limit)
+	l := newLocalizer(prefs, s.defaultLang())
+	for i := range hits {
+		hits[i].Title = l.text(hits[i].Title)
+	}
+	return hits
+}
+
+// ExtractGeoTags walks a JSON engine result and picks every object
+// carrying numeric "lat" and "lng" fields; a plain string title is taken
+// to be in lang.
+func ExtractGeoTags(result string, lang string) []GeoTag {
+	var v interface{}
+	if err := json.Unmarshal([]byte(result), &v); err != nil {
+		return nil
+	}
+	var tags []GeoTag
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			lat, okLat := v["lat"].(float64)
+			lng, okLng := v["lng"].(float64)
+			if okLat && okLng {
+				tag := GeoTag{Lat: lat, Lng: lng}
+				tag.Id, _ = v["id"].(string)
+				switch title := v["title"].(type) {
+				case string:
+					tag.Title = map[string]string{lang: title}
+				case map[string]interface{}:
+					tag.Title = make(map[string]string)
+					for k, t := range title {
+						if t, ok := t.(string); ok {
+							tag.Title[k] = t
+						}
+					}
+				}
+				tags = append(tags, tag)
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(v)
+	return tags
+}
@@ -0,0 +1,120 @@
+package knowdy
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/globbie/aide/pkg/session"
+	"golang.org/x/text/language"
+)
+
+var testGeoTags = []GeoTag{
+	{Id: "kremlin", Lat: 55.7520, Lng: 37.6175, Title: map[string]string{"en": "Kremlin", "ru": "Кремль"}},
+	{Id: "gum", Lat: 55.7547, Lng: 37.6215, Title: map[string]string{"en": "GUM"}},
+	{Id: "hermitage", Lat: 59.9398, Lng: 30.3146, Title: map[string]string{"en": "Hermitage"}},
+	{Id: "fiji-w", Lat: -17.8, Lng: 179.99},
+	{Id: "fiji-e", Lat: -17.8, Lng: -179.99},
+}
+
+func TestHaversine(t *testing.T) {
+	// Moscow - Saint Petersburg is about 634 km
+	d := haversine(55.7520, 37.6175, 59.9398, 30.3146)
+	if math.Abs(d-634) > 5 {
+		t.Errorf("got %v km", d)
+	}
+}
+
+func TestGeoIndexNearby(t *testing.T) {
+	idx := NewGeoIndex(testGeoTags)
+
+	hits := idx.Nearby(55.7525, 37.6180, 1, 10)
+	if len(hits) != 2 || hits[0].Id != "kremlin" || hits[1].Id != "gum" {
+		t.Fatalf("got %v", hits)
+	}
+	if hits := idx.Nearby(55.7525, 37.6180, 1, 1); len(hits) != 1 {
+		t.Errorf("limit ignored: %v", hits)
+	}
+	if hits := idx.Nearby(0, 0, 50, 10); len(hits) != 0 {
+		t.Errorf("got %v", hits)
+	}
+	// the antimeridian splits the grid but not the search
+	if hits := idx.Nearby(-17.8, 179.999, 5, 10); len(hits) != 2 {
+		t.Errorf("antimeridian: got %v", hits)
+	}
+}
+
+func TestNearbyGeoTagsLocalized(t *testing.T) {
+	var s Shard
+	s.IndexGeoTags(testGeoTags)
+	hits := s.NearbyGeoTags(55.7520, 37.6175, 0.5, 10, []language.Tag{language.Russian})
+	if len(hits) == 0 || hits[0].Title["ru"] != "Кремль" || len(hits[0].Title) != 1 {
+		t.Errorf("got %v", hits)
+	}
+}
+
+func TestEngineGeoTagsBounded(t *testing.T) {
+	defer func(max int) { MaxEngineGeoTags = max }(MaxEngineGeoTags)
+	MaxEngineGeoTags = 2
+
+	var s Shard
+	s.IndexGeoTags(testGeoTags[:2])
+	// the same id moves instead of piling up
+	s.IndexGeoTags([]GeoTag{{Id: "kremlin", Lat: 59.9398, Lng: 30.3146}})
+	if n := s.engineGeo.len(); n != 2 {
+		t.Fatalf("got %d tags", n)
+	}
+	if hits := s.nearbyGeoTags(55.7520, 37.6175, 0.1, 10); len(hits) != 0 {
+		t.Errorf("moved tag still at its old place: %v", hits)
+	}
+	if hits := s.nearbyGeoTags(59.9398, 30.3146, 0.1, 10); len(hits) != 1 || hits[0].Id != "kremlin" {
+		t.Errorf("got %v", hits)
+	}
+
+	s.IndexGeoTags(testGeoTags[2:3])
+	if n := s.engineGeo.len(); n != 2 {
+		t.Fatalf("got %d tags", n)
+	}
+	if hits := s.nearbyGeoTags(59.9398, 30.3146, 0.1, 10); len(hits) != 1 || hits[0].Id != "hermitage" {
+		t.Errorf("the oldest tag should have been evicted: %v", hits)
+	}
+}
+
+func TestExtractGeoTags(t *testing.T) {
+	result := `{"class": "Place", "instances": [
+		{"id": "p1", "lat": 1.5, "lng": 2.5, "title": "One"},
+		{"id": "p2", "geo": {"lat": 3, "lng": 4, "title": {"ru": "Два"}}},
+		{"id": "p3", "lat": "bad", "lng": 1}
+	]}`
+	tags := ExtractGeoTags(result, "en")
+	if len(tags) != 2 {
+		t.Fatalf("got %v", tags)
+	}
+	byLat := map[float64]GeoTag{}
+	for _, tag := range tags {
+		byLat[tag.Lat] = tag
+	}
+	if byLat[1.5].Id != "p1" || byLat[1.5].Title["en"] != "One" || byLat[3].Title["ru"] != "Два" {
+		t.Errorf("got %v", tags)
+	}
+	if tags := ExtractGeoTags("not json", "en"); tags != nil {
+		t.Errorf("got %v", tags)
+	}
+}
+
+func TestCacheLookupAttachesNearby(t *testing.T) {
+	s, _, _ := loadTestShard(t)
+	s.IndexGeoTags(testGeoTags)
+	ses := &session.ChatSession{Location: &session.Location{Lat: 55.7520, Lng: 37.6175}}
+	out, err := s.CacheLookup(ses, "main", "hello", []string{"en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply Message
+	if err := json.Unmarshal([]byte(out), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.GeoTags) != 2 {
+		t.Errorf("got %v", reply.GeoTags)
+	}
+}
@@ -0,0 +1,207 @@
+package knowdy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// GlottieError is a non-2xx reply of the ling-proc service.
+type GlottieError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *GlottieError) Error() string {
+	return fmt.Sprintf("glottie replied %d: %s", e.StatusCode, e.Body)
+}
+
+// GlottieClient talks to the Glottie ling-proc service over a pooled
+// HTTP client. Decode calls are retried with jittered backoff; every call
+// goes through a circuit breaker so a dead service fails fast.
+type GlottieClient struct {
+	Address       string
+	DecodeTimeout time.Duration
+	EncodeTimeout time.Duration
+	MaxRetries    int
+	RetryBackoff  time.Duration
+
+	client  *http.Client
+	breaker *circuitBreaker
+}
+
+func NewGlottieClient(address string) *GlottieClient {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   2 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &GlottieClient{
+		Address:       address,
+		DecodeTimeout: 7 * time.Second,
+		EncodeTimeout: 10 * time.Second,
+		MaxRetries:    2,
+		RetryBackoff:  100 * time.Millisecond,
+		client:        &http.Client{Transport: transport},
+		breaker:       newCircuitBreaker(5, 10*time.Second),
+	}
+}
+
+// Available is false while the circuit breaker is open.
+func (g *GlottieClient) Available() bool {
+	return !g.breaker.open()
+}
+
+// Ping checks that the service answers HTTP at all; it bypasses the
+// circuit breaker but reports it open.
+func (g *GlottieClient) Ping(ctx context.Context) error {
+	if !g.Available() {
+		return ErrCircuitOpen
+	}
+	u := url.URL{Scheme: "http", Host: g.Address, Path: "/"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return &GlottieError{resp.StatusCode, ""}
+	}
+	return nil
+}
+
+// Decode turns text into a graph, returning the discourse type reported
+// in the GLT-Discourse-Type header.
+func (g *GlottieClient) Decode(ctx context.Context, text string, lang string) (string, string, error) {
+	u := url.URL{Scheme: "http", Host: g.Address, Path: "/decode"}
+	parameters := url.Values{}
+	parameters.Add("t", text)
+	parameters.Add("lang", lang)
+	u.RawQuery = parameters.Encode()
+
+	var err error
+	for attempt := 0; attempt <= g.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if err = g.sleep(ctx, attempt); err != nil {
+				break
+			}
+		}
+		var body []byte
+		var header http.Header
+		body, header, err = g.do(ctx, g.DecodeTimeout, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		})
+		if err == nil {
+			return string(body), header.Get("GLT-Discourse-Type"), nil
+		}
+		if !retryable(err) {
+			break
+		}
+		log.Println("-- glottie decode attempt", attempt+1, "failed:", err)
+	}
+	return "", "", err
+}
+
+// Encode renders a graph into text; it is not retried.
+func (g *GlottieClient) Encode(ctx context.Context, graph string, lang string) (string, error) {
+	u := url.URL{Scheme: "http", Host: g.Address, Path: "/encode"}
+	parameters := url.Values{}
+	parameters.Add("cs", lang)
+	u.RawQuery = parameters.Encode()
+
+	body, _, err := g.do(ctx, g.EncodeTimeout, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewBufferString(graph))
+		if err == nil {
+			req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		return req, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (g *GlottieClient) do(ctx context.Context, timeout time.Duration,
+	newRequest func(context.Context) (*http.Request, error)) ([]byte, http.Header, error) {
+	if err := g.breaker.allow(); err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, header, err := g.roundTrip(ctx, newRequest)
+	// client errors and cancellations by the caller say nothing of the service health
+	var gerr *GlottieError
+	healthy := err == nil || (errors.As(err, &gerr) && gerr.StatusCode < 500) ||
+		errors.Is(err, context.Canceled)
+	g.breaker.done(healthy)
+	return body, header, err
+}
+
+func (g *GlottieClient) roundTrip(ctx context.Context,
+	newRequest func(context.Context) (*http.Request, error)) ([]byte, http.Header, error) {
+	req, err := newRequest(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read glottie reply: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, &GlottieError{resp.StatusCode, string(body)}
+	}
+	return body, resp.Header, nil
+}
+
+// sleep waits for an exponential backoff with full jitter: a random
+// duration in [0, RetryBackoff*2^(attempt-1)).
+func (g *GlottieClient) sleep(ctx context.Context, attempt int) error {
+	backoff := g.RetryBackoff << uint(attempt-1)
+	if backoff <= 0 {
+		return nil
+	}
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(backoff))))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func retryable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var gerr *GlottieError
+	if errors.As(err, &gerr) {
+		return gerr.StatusCode >= 500 || gerr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package knowdy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestGlottie(ts *httptest.Server) *GlottieClient {
+	g := NewGlottieClient(ts.URL[7:]) // strip off http:// prefix
+	g.RetryBackoff = time.Millisecond
+	return g
+}
+
+func TestGlottieDecodeRetries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("GLT-Discourse-Type", "query")
+		_, _ = io.WriteString(w, "{class Banana}")
+	}))
+	defer ts.Close()
+
+	graph, discourse, err := newTestGlottie(ts).Decode(context.Background(), "banana", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graph != "{class Banana}" || discourse != "query" {
+		t.Errorf("got %q %q", graph, discourse)
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls", calls)
+	}
+}
+
+func TestGlottieDecodeClientError(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "bad lang", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	_, _, err := newTestGlottie(ts).Decode(context.Background(), "banana", "xx")
+	var gerr *GlottieError
+	if !errors.As(err, &gerr) || gerr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("client errors must not be retried, got %d calls", calls)
+	}
+}
+
+func TestGlottieEncode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.URL.Query().Get("cs") != "ru" || string(body) != "{class Banana}" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		_, _ = io.WriteString(w, "банан")
+	}))
+	defer ts.Close()
+
+	text, err := newTestGlottie(ts).Encode(context.Background(), "{class Banana}", "ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "банан" {
+		t.Errorf("got %q", text)
+	}
+}
+
+func TestGlottieCircuitBreaker(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	g := newTestGlottie(ts)
+	g.MaxRetries = 0
+	now := time.Now()
+	g.breaker.now = func() time.Time { return now }
+
+	for i := 0; i < g.breaker.maxFailures; i++ {
+		if _, _, err := g.Decode(context.Background(), "banana", "en"); err == nil {
+			t.Fatal("expected a failure")
+		}
+	}
+	if g.Available() {
+		t.Error("breaker should be open")
+	}
+	before := atomic.LoadInt32(&calls)
+	if _, _, err := g.Decode(context.Background(), "banana", "en"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	if atomic.LoadInt32(&calls) != before {
+		t.Error("open breaker let a call through")
+	}
+
+	// after the cooldown a single trial goes out
+	now = now.Add(g.breaker.cooldown)
+	if _, _, err := g.Decode(context.Background(), "banana", "en"); errors.Is(err, ErrCircuitOpen) {
+		t.Error("trial call was not let through")
+	}
+	if atomic.LoadInt32(&calls) != before+1 {
+		t.Error("expected exactly one trial call")
+	}
+}
+
+func TestGlottieContextCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := newTestGlottie(ts).Decode(ctx, "banana", "en"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("the caller deadline was not propagated")
+	}
+}
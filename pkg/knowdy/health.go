@@ -0,0 +1,143 @@
+package knowdy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ProbeTask is run on a worker to check the engine end to end.
+	ProbeTask    = "{task}"
+	ProbeTimeout = 2 * time.Second
+)
+
+// DependencyStatus is the outcome of a single readiness check.
+type DependencyStatus struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	Detail    string  `json:"detail,omitempty"`
+	LatencyMs float64 `json:"latency-ms"`
+}
+
+type Readiness struct {
+	Ready  bool               `json:"ready"`
+	Checks []DependencyStatus `json:"checks"`
+}
+
+// pinger is implemented by ling processors behind a network service.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// CheckReadiness runs every dependency check concurrently, each bounded
+// by ProbeTimeout.
+func (s *Shard) CheckReadiness(ctx context.Context) Readiness {
+	checks := []struct {
+		name string
+		fn   func(context.Context) (string, error)
+	}{
+		{"shard", s.checkShard},
+		{"worker", s.checkWorker},
+		{"caches", s.checkCaches},
+		{"glottie", s.checkLingProc},
+		{"authority", s.checkAuthority},
+	}
+	r := Readiness{Ready: true, Checks: make([]DependencyStatus, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, name string, fn func(context.Context) (string, error)) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, ProbeTimeout)
+			defer cancel()
+			start := time.Now()
+			detail, err := fn(ctx)
+			status := DependencyStatus{
+				Name:      name,
+				OK:        err == nil,
+				Detail:    detail,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				status.Detail = err.Error()
+			}
+			r.Checks[i] = status
+		}(i, c.name, c.fn)
+	}
+	wg.Wait()
+	for _, c := range r.Checks {
+		r.Ready = r.Ready && c.OK
+	}
+	return r
+}
+
+func (s *Shard) checkShard(ctx context.Context) (string, error) {
+	s.resizeMu.Lock()
+	closed := s.closed
+	s.resizeMu.Unlock()
+	switch {
+	case s.shard == nil || closed:
+		return "", ErrShardClosed
+	case atomic.LoadInt32(&s.draining) != 0:
+		return "", ErrShardDraining
+	case atomic.LoadInt32(&s.ready) == 0:
+		return "", errors.New("shard is still loading")
+	}
+	stats := s.PoolStats()
+	return fmt.Sprintf("%d of %d workers busy", stats.Busy, stats.Size), nil
+}
+
+// checkWorker round-trips ProbeTask through a worker. A probe stuck
+// behind busy workers is not started again until it finishes.
+func (s *Shard) checkWorker(ctx context.Context) (string, error) {
+	if !atomic.CompareAndSwapInt32(&s.probing, 0, 1) {
+		return "", errors.New("previous probe is still waiting for a worker")
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer atomic.StoreInt32(&s.probing, 0)
+		_, _, _, err := s.runTask(ProbeTask, len(ProbeTask))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return "", err
+	case <-ctx.Done():
+		return "", fmt.Errorf("no worker available: %w", ctx.Err())
+	}
+}
+
+func (s *Shard) checkCaches(ctx context.Context) (string, error) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		return "", errors.New("caches are not loaded")
+	}
+	c := s.Cache()
+	return fmt.Sprintf("%d scripts, %d languages", len(c.Scripts), len(c.MsgIdx)), nil
+}
+
+func (s *Shard) checkLingProc(ctx context.Context) (string, error) {
+	p, ok := s.lingProc().(pinger)
+	if !ok {
+		return "local ling processor", nil
+	}
+	return "", p.Ping(ctx)
+}
+
+func (s *Shard) checkAuthority(ctx context.Context) (string, error) {
+	address := s.authority()
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "80")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	return address, nil
+}
@@ -0,0 +1,80 @@
+package knowdy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestReadyShard(t *testing.T) *Shard {
+	authority := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(authority.Close)
+
+	shard := newTestPoolShard(t, 2)
+	local, err := NewLocalLingProc("testdata/system-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard.LingProc = local
+	shard.KnowdyAddress = authority.Listener.Addr().String()
+	return shard
+}
+
+func failedChecks(r Readiness) []string {
+	var failed []string
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed = append(failed, c.Name+": "+c.Detail)
+		}
+	}
+	return failed
+}
+
+func TestReadiness(t *testing.T) {
+	shard := newTestReadyShard(t)
+	r := shard.CheckReadiness(context.Background())
+	if !r.Ready || len(r.Checks) != 5 {
+		t.Fatalf("expected a ready shard, failed checks: %v", failedChecks(r))
+	}
+
+	if err := shard.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r := shard.CheckReadiness(context.Background()); r.Ready {
+		t.Error("a draining shard must not be ready")
+	}
+	shard.Del()
+	if r := shard.CheckReadiness(context.Background()); r.Ready {
+		t.Error("a deleted shard must not be ready")
+	}
+}
+
+func TestReadinessAuthorityDown(t *testing.T) {
+	shard := newTestReadyShard(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard.KnowdyAddress = l.Addr().String()
+	l.Close()
+
+	r := shard.CheckReadiness(context.Background())
+	failed := failedChecks(r)
+	if r.Ready || len(failed) != 1 {
+		t.Errorf("expected only the authority to fail, got %v", failed)
+	}
+}
+
+func TestGlottiePing(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	g := newTestGlottie(ts)
+	if err := g.Ping(context.Background()); err != nil {
+		t.Errorf("any reply means reachable, got %v", err)
+	}
+	ts.Close()
+	if err := g.Ping(context.Background()); err == nil {
+		t.Error("expected an error from a closed server")
+	}
+}
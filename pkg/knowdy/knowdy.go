@@ -18,19 +18,23 @@ import "C"
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/globbie/aide/pkg/session"
+	"golang.org/x/text/language"
 )
 
 type KnowdyClaims struct {
@@ -87,8 +91,13 @@ type LangCache struct {
 
 type ShardInfo struct {
 	Name          string               `json:"name"`
-	MaxCapacity   int
-	Capacity      int
+	Address       string               `json:"address"`
+	MaxCapacity   int                  `json:"max-capacity"`
+	Capacity      int                  `json:"capacity"`
+	Healthy       bool                 `json:"healthy"`
+	Failures      int                  `json:"failures,omitempty"` // failed polls in a row
+	CheckedAt     time.Time            `json:"checked-at,omitempty"`
+	Err           string               `json:"error,omitempty"`
 }
 
 type Shard struct {
@@ -98,12 +107,30 @@ type Shard struct {
 	KnowdyAddress       string
 	KnowdyServiceName   string
 	LingProcAddress     string
+	DefaultLang         string
+	LingProc            LingProcessor
+	lingProcOnce        sync.Once
+	DecodeCache         *DecodeCache
+	Outbox              *CommitOutbox
 	workers             chan *C.struct_kndTask
-	PeerShards          []ShardInfo
-	Resources           map[string]Resource
-	Scripts             map[string]Script
-	LangCaches          []LangCache
-	MsgIdx              map[string][]MsgInterp
+	maxWorkers          int
+	poolSize            int32
+	busy                int32
+	inflight            int32
+	draining            int32
+	ready               int32
+	probing             int32
+	nextTaskId          int32
+	resizeMu            sync.Mutex
+	closed              bool
+	Observer            PoolObserver
+	PeerShards          *ShardRegistry
+	Resources           *ResourceStore
+	cache               atomic.Value // *ScriptCache
+	engineGeo           engineGeoIndex
+	cacheMu             sync.Mutex
+	scriptCachePath     string
+	msgCachePath        string
 }
 
 type Resource struct {
@@ -127,20 +154,41 @@ type Message struct {
 	GeoTags   []GeoTag            `json:"geotags,omitempty"`
 	Quest     map[string]string   `json:"quest,omitempty"`
 	Menu      []MenuOption        `json:"menu,omitempty"`
+	Locale    string              `schema:"-" json:"locale,omitempty"`
+	Lat       *float64            `schema:"lat" json:"-"`
+	Lng       *float64            `schema:"lng" json:"-"`
 }
 
 var (
 	MaxResources     = 7
+	// DefaultLang is the default of ShardOptions.DefaultLang.
+	DefaultLang      = "en"
+	FuzzyMatchThreshold = 0.75
 	DBCacheFilename    = "/etc/aide/dbcache.json"
 	MsgCacheFilename    = "/etc/aide/msgcache.json"
 )
 
-func New(conf string, KnowdyAddress string,  KnowdyServiceName string, LingProcAddress string, ServiceDomain string, PeerShards []string, concurrencyFactor int) (*Shard, error) {
+// ShardOptions tune a single shard; zero fields take the package
+// defaults.
+type ShardOptions struct {
+	DefaultLang      string
+	PlacementShards  []string
+	PollInterval     time.Duration
+	CommitOutboxPath string
+	DecodeCacheSize  int
+	DecodeCacheTTL   time.Duration
+	MaxWorkers       int
+}
+
+func New(conf string, KnowdyAddress string,  KnowdyServiceName string, LingProcAddress string, ServiceDomain string, PeerShards []string, concurrencyFactor int, opts ShardOptions) (*Shard, error) {
 	var shard *C.struct_kndShard = nil
-	errCode := C.knd_shard_new((**C.struct_kndShard)(&shard), C.CString(conf), C.size_t(len(conf)))
+	cs := C.CString(conf)
+	defer C.free(unsafe.Pointer(cs))
+	errCode := C.knd_shard_new((**C.struct_kndShard)(&shard), cs, C.size_t(len(conf)))
 	if errCode != C.int(0) {
 		return nil, errors.New("failed to create a Shard struct")
 	}
+	atomic.AddInt64(&liveShards, 1)
 
 	s := Shard{
 		shard:         shard,
@@ -148,41 +196,85 @@ func New(conf string, KnowdyAddress string,  KnowdyServiceName string, LingProcA
 		KnowdyAddress: KnowdyAddress,
 		KnowdyServiceName: KnowdyServiceName,
 		LingProcAddress: LingProcAddress,
-		workers:    make(chan *C.struct_kndTask, concurrencyFactor),
+		DefaultLang: opts.DefaultLang,
+		LingProc:   NewGlottieClient(LingProcAddress),
+		maxWorkers: opts.MaxWorkers,
 	}
-
-	for _, element := range PeerShards {
-		si := ShardInfo{
-			Name: element,
+	if s.DefaultLang == "" {
+		s.DefaultLang = DefaultLang
+	}
+	cacheSize, cacheTTL := DecodeCacheSize, DecodeCacheTTL
+	if opts.DecodeCacheSize != 0 {
+		cacheSize = opts.DecodeCacheSize
+	}
+	if opts.DecodeCacheTTL != 0 {
+		cacheTTL = opts.DecodeCacheTTL
+	}
+	s.DecodeCache = NewDecodeCache(cacheSize, cacheTTL)
+	// undo everything built so far unless construction succeeds
+	ok := false
+	defer func() {
+		if !ok {
+			s.Del()
 		}
-		s.PeerShards = append(s.PeerShards, si)
+	}()
+
+	s.PeerShards = NewShardRegistry(PeerShardInfo(KnowdyServiceName, KnowdyAddress, PeerShards))
+	if len(opts.PlacementShards) > 0 {
+		s.PeerShards.Placement = opts.PlacementShards
+	}
+	if opts.PollInterval != 0 {
+		s.PeerShards.PollInterval = opts.PollInterval
+	}
+
+	if err := s.newWorkers(concurrencyFactor); err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < concurrencyFactor; i++ {
-		var task *C.struct_kndTask
-		errCode := C.knd_task_new(shard, nil, C.int(i), &task)
-		if errCode != C.int(0) {
-			// todo(n.rodionov): call destructor
-			return nil, errors.New("could not create kndTask")
+	if opts.CommitOutboxPath != "" {
+		outbox, err := OpenCommitOutbox(opts.CommitOutboxPath, s.sendCommit)
+		if err != nil {
+			return nil, err
 		}
-		s.workers <- task
+		s.Outbox = outbox
+		go outbox.Run()
 	}
 
 	err := s.PopulateScriptCache(DBCacheFilename)
 	if err != nil {
-		return nil, errors.New("failed to read json script db cache")
+		return nil, err
 	}
 	err = s.PopulateMsgCache(MsgCacheFilename)
 	if err != nil {
-		return nil, errors.New("failed to read msg cache")
+		return nil, err
 	}
-	
+
+	ok = true
+	atomic.StoreInt32(&s.ready, 1)
 	return &s, nil
 }
 
+// Del waits for the tasks in flight, then frees the workers and the
+// engine. Calling it again is a no-op.
 func (s *Shard) Del() error {
-	C.kndShard_del__(s.shard)
-	return nil
+	s.resizeMu.Lock()
+	defer s.resizeMu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var err error
+	if s.Outbox != nil {
+		err = s.Outbox.Close()
+	}
+	s.delWorkers()
+	if s.shard != nil {
+		C.kndShard_del__(s.shard)
+		s.shard = nil
+		atomic.AddInt64(&liveShards, -1)
+	}
+	return err
 }
 
 func taskTypeToStr(v C.int) string {
@@ -198,69 +290,66 @@ func taskTypeToStr(v C.int) string {
 	}
 }
 
-func (s *Shard) PopulateScriptCache(Filename string) (error) {
-	CacheBytes, err := ioutil.ReadFile(Filename)
+func (s *Shard) RunTask(task string, TaskLen int) (string, string, error) {
+	return s.RunTaskContext(context.Background(), task, TaskLen)
+}
+
+// RunTaskContext is RunTask for a request: a confirmed commit is waited
+// for until ctx is done, then ErrCommitPending is returned.
+func (s *Shard) RunTaskContext(ctx context.Context, task string, TaskLen int) (string, string, error) {
+	reply, taskType, phase, err := s.runTask(task, TaskLen)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return errors.New("failed to read json db cache")
+		return reply, "", err
 	}
-	err = json.Unmarshal(CacheBytes, &s.Scripts)
-	if err != nil {
-		// log.Println("Unmarshal: ", err.Error())
-		return errors.New("failed to read json script db cache")
+
+	// check if we need to write to the authority node
+	switch phase {
+	case C.KND_CONFIRM_COMMIT:
+		reply, err := s.forwardCommit(ctx, reply)
+		return reply, "commit", err
+	default:
+		return reply, taskType, nil
 	}
-	// script := s.Scripts["explore"]
-	// phase := script.ScriptPhases["init"]
-	// b, _ := json.Marshal(phase)
-	return nil
 }
 
-func (s *Shard) PopulateMsgCache(Filename string) (error) {
-	s.MsgIdx = make(map[string][]MsgInterp)
-
-	// if _, err := os.Stat(Filename); os.IsNotExist(err) {
-	//		return nil
-	// }
-
-	CacheBytes, err := ioutil.ReadFile(Filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return errors.New("failed to read json msg cache")
+// defaultLang is the language replies fall back to.
+func (s *Shard) defaultLang() string {
+	if s.DefaultLang != "" {
+		return s.DefaultLang
 	}
+	return DefaultLang
+}
 
-	err = json.Unmarshal(CacheBytes, &s.LangCaches)
-	if err != nil {
-		log.Println("Unmarshalling JSON Msg DB failed: ", err.Error())
-		return errors.New("failed to parse json msg cache")
+// authority is the knowdy node that applies confirmed commits and serves
+// reads that must see them.
+func (s *Shard) authority() string {
+	if s.KnowdyAddress != "" {
+		return s.KnowdyAddress
 	}
-
-	for _, lc := range s.LangCaches {
-		for _, ctx := range lc.ScriptCtxs {
-			for _, react := range ctx.ScriptReacts {
-				for _, trig := range react.Triggers {
-					s.RegisterMsg(trig, react, ctx)
-				}}}}
-	return nil
+	return s.KnowdyServiceName
 }
 
-func (s *Shard) RegisterMsg(msg string, react ScriptReact, ctx ScriptCtx) (error) {
-	uc_msg := strings.ToUpper(msg)
-	interps, is_present := s.MsgIdx[uc_msg]
-	if !is_present {
-		interps = make([]MsgInterp, 0)
+// forwardCommit hands a confirmed commit to the outbox, or posts it
+// directly when no outbox is configured.
+func (s *Shard) forwardCommit(ctx context.Context, gsl string) (string, error) {
+	if s.Outbox == nil {
+		return s.ApplyCommit(s.authority(), gsl)
 	}
-	interp := MsgInterp{&ctx, &react}
-	s.MsgIdx[uc_msg] = append(interps, interp)
-	return nil
+	key, reply, err := s.Outbox.Commit(ctx, gsl)
+	if errors.Is(err, ErrCommitPending) {
+		return "{\"commit\":\"" + key + "\",\"status\":\"pending\"}", err
+	}
+	return reply, err
 }
 
-func (s *Shard) RunTask(task string, TaskLen int) (string, string, error) {
-	worker := <-s.workers
-	defer func() { s.workers <- worker }()
+// runTask executes a task on a free worker and reports the task type and
+// the phase the engine ended in.
+func (s *Shard) runTask(task string, TaskLen int) (string, string, C.int, error) {
+	worker, err := s.acquire()
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer s.release(worker)
 
 	var ctx C.struct_kndTaskContext
 	worker.ctx = &ctx
@@ -270,20 +359,19 @@ func (s *Shard) RunTask(task string, TaskLen int) (string, string, error) {
 	defer C.free(unsafe.Pointer(cs))
 
 	log.Println(">> running task: ", task)
+	start := time.Now()
 	errCode := C.knd_task_run(worker, cs, C.size_t(TaskLen))
 	reply := C.GoStringN((*C.char)(worker.output), C.int(worker.output_size))
 	if errCode != C.int(0) {
-		return reply, "", errors.New("task execution failed")
+		s.observeTask("error", phaseToStr(C.int(ctx.phase)), start)
+		return reply, "", 0, errors.New("task execution failed")
 	}
-
-	// check if we need to write to the authority node
-        switch C.int(ctx.phase) {
-	case C.KND_CONFIRM_COMMIT:
-		reply, err := s.ApplyCommit(s.KnowdyServiceName, C.GoStringN((*C.char)(worker.output), C.int(worker.output_size)))
-		return reply, "commit", err
-	default:
-		return reply, taskTypeToStr(C.int(0)), nil
+	taskType := taskTypeToStr(C.int(ctx._type))
+	if C.int(ctx.phase) == C.KND_CONFIRM_COMMIT {
+		taskType = "commit"
 	}
+	s.observeTask(taskType, phaseToStr(C.int(ctx.phase)), start)
+	return reply, taskType, C.int(ctx.phase), nil
 }
 
 func (s *Shard) ApplyCommit(Address string, GSL string) (string, error) {
@@ -305,68 +393,115 @@ func (s *Shard) ApplyCommit(Address string, GSL string) (string, error) {
 	return string(body), nil
 }
 
-func buildMsgReply(ses *session.ChatSession, tid string, ctx string, phase ScriptPhase, lang string) (string, error) {
-	//var body strings.Builder
-	// body.WriteString("--")
-	// body.String()
-	log.Println(ses)
-	
-	reply := Message{nil, ctx, "stm", lang,
-		map[string]string{"en":"Reply"}, "", phase.Body, map[string]string{"en":"-- restate --"}, nil,
-		phase.Resources, phase.GeoTags, phase.Quest, phase.Menu}
+// buildMsgReply selects a single translation of every phase text,
+// preferring the language the trigger matched in, then the session languages.
+func buildMsgReply(ses *session.ChatSession, tid string, ctx string, phase ScriptPhase, lang string, defaultLang string) (string, error) {
+	prefs := []language.Tag{language.Make(lang)}
+	if ses != nil {
+		prefs = append(prefs, ses.Langs...)
+	}
+	l := newLocalizer(prefs, defaultLang)
+
+	if len(phase.Resources) > MaxResources {
+		log.Println("-- phase", phase.Id, "of script", tid, "has", len(phase.Resources),
+			"resources, only", MaxResources, "are sent")
+		phase.Resources = phase.Resources[:MaxResources]
+	}
+
+	reply := Message{
+		Ctx:       ctx,
+		Discourse: "stm",
+		Body:      l.text(phase.Body),
+		Quest:     l.text(phase.Quest),
+		Menu:      l.menu(phase.Menu),
+		Resources: l.resources(phase.Resources),
+		GeoTags:   l.geoTags(phase.GeoTags),
+	}
+	reply.Subj = l.text(replySubj)
+	reply.Restate = l.text(replyRestate)
+	reply.Lang = lang
+	reply.Locale = l.Locale
 
 	b, _ := json.Marshal(reply)
 	return string(b), nil
 }
 
-func (s *Shard) CacheLookup(ses *session.ChatSession, ctx string, msg string, lang string) (string, error) {
-	k := strings.ToUpper(msg)
-	k = strings.TrimSpace(k)
+// CacheLookup searches the message index along the language fallback
+// chain: exact triggers in every language first, then fuzzy matches.
+func (s *Shard) CacheLookup(ses *session.ChatSession, ctx string, msg string, langs []string) (string, error) {
+	cache := s.Cache()
 
-	interps, is_present := s.MsgIdx[k]
-	if !is_present {
-		return "", errors.New("key not present in cache")
+	var interp *MsgInterp
+	var lang string
+	for _, lang = range langs {
+		interp = findInterp(cache.MsgIdx[lang][NormalizeMsg(msg, lang)], ctx)
+		if interp != nil {
+			break
+		}
+	}
+	if interp == nil {
+		// near misses still deserve a scripted reaction
+	fuzzy:
+		for _, lang = range langs {
+			for _, match := range cache.MsgIdx[lang].FuzzyMatch(NormalizeMsg(msg, lang), FuzzyMatchThreshold) {
+				interp = findInterp(match.Interps, ctx)
+				if interp != nil {
+					log.Println("fuzzy match: ", match.Key, " lang:", lang, " score:", match.Score)
+					break fuzzy
+				}
+			}
+		}
+	}
+	if interp == nil {
+		return "", errors.New("no valid interp found")
 	}
 
-	for _, interp := range interps {
-		if ctx != interp.ScriptCtx.Id { continue }
-
-		log.Println("Ctx: ", interp.ScriptCtx.Id, " React:", interp.ScriptReact.Id)
+	log.Println("Ctx: ", interp.ScriptCtx.Id, " React:", interp.ScriptReact.Id, " Lang:", lang)
 
-		script, is_present := s.Scripts[interp.ScriptReact.Id]
-		if !is_present {
-			return "", errors.New("script not found")
-		}
-		return buildMsgReply(ses, script.Id, interp.ScriptReact.Id, script.ScriptPhases["init"], lang)
+	script, is_present := cache.Scripts[interp.ScriptReact.Id]
+	if !is_present {
+		return "", errors.New("script not found")
+	}
+	phase := script.ScriptPhases["init"]
+	phase.Resources = s.Resources.Resolve(phase.Resources)
+	if ses != nil && ses.Location != nil {
+		phase.GeoTags = mergeGeoTags(phase.GeoTags, s.nearbyGeoTags(ses.Location.Lat, ses.Location.Lng,
+			NearbyRadiusKm, NearbyLimit))
 	}
-	return "", errors.New("no valid interp found")
+	return buildMsgReply(ses, script.Id, interp.ScriptReact.Id, phase, lang, s.defaultLang())
 }
 
-func (s *Shard) ProcessMsg(msg *Message) (string, error) {
-	msg.Lang = "en" // default lang
-	if len(msg.ChatSession.Langs) > 0 {
-		msg.Lang = msg.ChatSession.Langs[0].String()
-		i := strings.Index(msg.Lang, "-")
-		if i != -1 {
-			msg.Lang = msg.Lang[:i]
+func findInterp(interps []MsgInterp, ctx string) *MsgInterp {
+	for i := range interps {
+		if interps[i].ScriptCtx.Id == ctx {
+			return &interps[i]
 		}
 	}
-	reply, err := s.CacheLookup(msg.ChatSession, msg.Ctx, msg.Input, msg.Lang)
+	return nil
+}
+
+func (s *Shard) ProcessMsg(ctx context.Context, msg *Message) (string, error) {
+	langs := msg.ChatSession.LangChain(s.defaultLang())
+	msg.Lang = langs[0]
+
+	reply, err := s.CacheLookup(msg.ChatSession, msg.Ctx, msg.Input, langs)
 	if err == nil {
 		return reply, nil
         }
-	reply, msg.Discourse, err = s.DecodeText(msg.Input, msg.Lang)
-	if err != nil {
-		return "", errors.New("text decoding failed :: " + err.Error())
-        }
-
+	if msg.ChatSession.Location != nil {
+		loc := msg.ChatSession.Location
+		msg.GeoTags = mergeGeoTags(nil, s.nearbyGeoTags(loc.Lat, loc.Lng, NearbyRadiusKm, NearbyLimit))
+		l := newLocalizer(msg.ChatSession.Langs, s.defaultLang())
+		msg.GeoTags = l.geoTags(msg.GeoTags)
+	}
 	{
-		json_interp_str, err := s.BuildJSON(reply, msg.Lang)
+		decoded, err := s.decode(ctx, msg.Input, msg.Lang)
 		if err != nil {
-			return "", errors.New("JSON encoding failed :: " + err.Error())
+			return "", err
 		}
-		log.Println(json_interp_str)
-		rawJSON := json.RawMessage(json_interp_str)
+		msg.Discourse = decoded.discourse
+		log.Println(decoded.interp)
+		rawJSON := json.RawMessage(decoded.interp)
 		msg.Interp = &rawJSON
 	}
         // decide what action is needed
@@ -409,8 +544,12 @@ func (s *Shard) CommitStatement(msg *Message) (string, error) {
 	gsl.WriteString(msg.Body[msg.Lang])
 	gsl.WriteString("}}}}}}}")
 
+	si, err := s.PeerShards.Route(msg.ChatSession.ShardId)
+	if err != nil {
+		return "", err
+	}
 	log.Println(">> stm commit in progress: ", gsl.String())
-	report, err := s.ApplyCommit(s.KnowdyAddress, gsl.String())
+	report, err := s.ApplyCommit(si.Address, gsl.String())
 	if err != nil {
 		return "", errors.New("failed to save a user message")
 	}
@@ -428,22 +567,19 @@ func (s *Shard) RunQuery(msg *Message) (string, error) {
 }
 
 func (s *Shard) CreateChatSession(ses *session.ChatSession, signKey *rsa.PrivateKey) (string, []*http.Cookie, error) {
-	var si *ShardInfo = nil
-	// select public shard to host a new session
-	// TODO: check current capacity
-	for _, elem := range s.PeerShards {
-		if elem.Name == "public" {
-			si = &elem
-			break
+	// select a shard with spare capacity to host a new session
+	si, err := s.PeerShards.Place()
+	if err != nil {
+		if s.Name != "" {
+			return "", nil, err
 		}
-	}
-	if si == nil {
-		return "", nil, errors.New("failed to find a public peer shard")
+		// a standalone instance hosts every session itself
+		si = ShardInfo{Address: s.authority()}
 	}
 	ses.ShardId = si.Name
 
 	gsl := bytes.Buffer{}
-	gsl.WriteString("{task {class User {!inst _")
+	gsl.WriteString("{task{format JSON}{class User {!inst _")
 	if ses.UserAgent != "" {
 		gsl.WriteString("[soft{" + ses.UserAgent +"}]")
 	}
@@ -461,33 +597,18 @@ func (s *Shard) CreateChatSession(ses *session.ChatSession, signKey *rsa.Private
 
 	// register new user
 	{
-		// var addr = s.KnowdyServiceName + "-" + si.Name
-		report, err := s.ApplyCommit(s.KnowdyAddress, gsl.String())
+		report, err := s.ApplyCommit(si.Address, gsl.String())
 		if err != nil {
 			log.Println("failed to register a user:" + report)
 			return "", nil, errors.New("failed to register a user")
 		}
-		log.Println(report)
-		// TMP
-		pref := "{class User{!inst "
-		pref_size := len(pref)
-		i := strings.Index(report, pref)
-		if i == -1 {
-			return "", nil, errors.New("failed to extract uid: no user inst")
-		}
-		remainder := report[i + pref_size:]
-		idbuf := bytes.Buffer{}
-		for _, c := range remainder {
-			if c == '{' || c == '[' || c == ' '{
-				break
-			}
-			idbuf.WriteByte(byte(c))
-		}
-		if idbuf.Len() == 0 {
-			return "", nil, errors.New("failed to extract uid")
+		rr, err := ParseRegistrationReport(report)
+		if err != nil {
+			log.Println("-- unexpected registration report:", report)
+			return "", nil, fmt.Errorf("failed to extract uid: %w", err)
 		}
-		ses.UserId = idbuf.String()
-		log.Println("== uid:", ses.UserId)
+		ses.UserId = rr.UserId
+		log.Println("== uid:", ses.UserId, "commit:", rr.CommitId)
 	}
 	// build access token
 	token, err := session.IssueAccessToken(ses, signKey, 64)
@@ -505,8 +626,11 @@ func (s *Shard) CreateChatSession(ses *session.ChatSession, signKey *rsa.Private
 }
 
 func (s *Shard) BuildJSON(Text string, Lang string) (string, error) {
-	worker := <-s.workers
-	defer func() { s.workers <- worker }()
+	worker, err := s.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer s.release(worker)
 
 	var ctx C.struct_kndTaskContext
 	worker.ctx = &ctx
@@ -521,7 +645,9 @@ func (s *Shard) BuildJSON(Text string, Lang string) (string, error) {
 	ctx.locale_size = C.size_t(len(Lang))
 	C.memcpy(unsafe.Pointer(&ctx.locale[0]), unsafe.Pointer(lang), ctx.locale_size)
 
+	start := time.Now()
 	errCode := C.knd_text_build_JSON(t, C.size_t(len(Text)), worker)
+	s.observeTask("build-json", phaseToStr(C.int(ctx.phase)), start)
 	if errCode != C.int(0) {
 		msg := C.GoStringN((*C.char)(worker.log.buf), C.int(worker.log.buf_size))
 		log.Println(msg)
@@ -1,7 +1,13 @@
 package knowdy
 
 import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const shardCfg = `
@@ -26,7 +32,7 @@ const shardCfg = `
 `
 
 func TestShard(t *testing.T) {
-	shard, err := New(shardCfg, "localhost:8081", "localhost:8069", 1)
+	shard, err := New(shardCfg, "localhost:8081", "knowdy", "localhost:8069", "localhost", []string{"public"}, 1, ShardOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -36,3 +42,143 @@ func TestShard(t *testing.T) {
 	// }
 	defer shard.Del()
 }
+
+func TestShardOptions(t *testing.T) {
+	opts := ShardOptions{
+		DefaultLang:     "ru",
+		PlacementShards: []string{"secure"},
+		PollInterval:    time.Minute,
+		DecodeCacheSize: 8,
+		DecodeCacheTTL:  time.Second,
+		MaxWorkers:      4,
+	}
+	shard, err := New(shardCfg, "localhost:8081", "knowdy", "localhost:8069", "localhost", []string{"public"}, 2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shard.Del()
+	other, err := New(shardCfg, "localhost:8081", "knowdy", "localhost:8069", "localhost", []string{"public"}, 2, ShardOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Del()
+
+	if shard.DefaultLang != "ru" || shard.PeerShards.Placement[0] != "secure" ||
+		shard.PeerShards.PollInterval != time.Minute || shard.PoolStats().Max != 4 ||
+		shard.DecodeCache.maxEntries != 8 || shard.DecodeCache.ttl != time.Second {
+		t.Errorf("options not applied: %+v", opts)
+	}
+	// a shard with other options leaves the defaults alone
+	if other.DefaultLang != DefaultLang || other.PeerShards.Placement[0] != PlacementShards[0] ||
+		other.PeerShards.PollInterval != ShardPollInterval || other.PoolStats().Max != MaxWorkers ||
+		other.DecodeCache.maxEntries != DecodeCacheSize {
+		t.Errorf("defaults changed by another shard")
+	}
+}
+
+func checkNoLeaks(t *testing.T, goroutines int) {
+	t.Helper()
+	if n := atomic.LoadInt64(&liveShards); n != 0 {
+		t.Errorf("%d shards leaked", n)
+	}
+	if n := atomic.LoadInt64(&liveTasks); n != 0 {
+		t.Errorf("%d tasks leaked", n)
+	}
+	// give exiting goroutines a moment
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%d goroutines leaked", n-goroutines)
+	}
+}
+
+func TestShardRepeatedNewDel(t *testing.T) {
+	scripts, msgs := writeTestCaches(t)
+	savedScripts, savedMsgs := DBCacheFilename, MsgCacheFilename
+	DBCacheFilename, MsgCacheFilename = scripts, msgs
+	defer func() { DBCacheFilename, MsgCacheFilename = savedScripts, savedMsgs }()
+	opts := ShardOptions{CommitOutboxPath: filepath.Join(t.TempDir(), "commits.wal")}
+
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		shard, err := New(shardCfg, "localhost:8081", "knowdy", "localhost:8069", "localhost", []string{"public"}, 4, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := shard.RunTask("{task}", len("{task}")); err != nil {
+			t.Fatal(err)
+		}
+		if err := shard.Del(); err != nil {
+			t.Fatal(err)
+		}
+		if err := shard.Del(); err != nil {
+			t.Errorf("second Del failed: %v", err)
+		}
+		if _, _, err := shard.RunTask("{task}", len("{task}")); !errors.Is(err, ErrShardClosed) {
+			t.Errorf("expected ErrShardClosed, got %v", err)
+		}
+	}
+	checkNoLeaks(t, goroutines)
+}
+
+func TestNewCleansUpOnFailure(t *testing.T) {
+	scripts, msgs := writeTestCaches(t)
+	savedScripts, savedMsgs := DBCacheFilename, MsgCacheFilename
+	DBCacheFilename, MsgCacheFilename = scripts, msgs
+	defer func() { DBCacheFilename, MsgCacheFilename = savedScripts, savedMsgs }()
+	goroutines := runtime.NumGoroutine()
+
+	taskNewHook = func(id int) error {
+		if id == 2 {
+			return errors.New("out of memory")
+		}
+		return nil
+	}
+	_, err := New(shardCfg, "localhost:8081", "knowdy", "localhost:8069", "localhost", []string{"public"}, 4, ShardOptions{})
+	taskNewHook = nil
+	if err == nil {
+		t.Fatal("expected New to fail")
+	}
+	checkNoLeaks(t, goroutines)
+
+	MsgCacheFilename = filepath.Join(t.TempDir(), "broken.json")
+	if err := ioutil.WriteFile(MsgCacheFilename, []byte("[{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(shardCfg, "localhost:8081", "knowdy", "localhost:8069", "localhost", []string{"public"}, 4, ShardOptions{}); err == nil {
+		t.Fatal("expected New to fail on a broken message cache")
+	}
+	checkNoLeaks(t, goroutines)
+
+	MsgCacheFilename = msgs
+	opts := ShardOptions{CommitOutboxPath: filepath.Join(t.TempDir(), "missing", "commits.wal")}
+	if _, err := New(shardCfg, "localhost:8081", "knowdy", "localhost:8069", "localhost", []string{"public"}, 4, opts); err == nil {
+		t.Fatal("expected New to fail on an unusable outbox")
+	}
+	checkNoLeaks(t, goroutines)
+}
+
+func TestDelWaitsForTasks(t *testing.T) {
+	shard := newTestPoolShard(t, 2)
+	worker, err := shard.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		shard.Del()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Del returned while a task was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	shard.release(worker)
+	<-done
+	if n := atomic.LoadInt64(&liveTasks); n != 0 {
+		t.Errorf("%d tasks leaked", n)
+	}
+}
@@ -0,0 +1,282 @@
+package knowdy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LingProcessor turns text into GSL graphs and back.
+type LingProcessor interface {
+	Decode(ctx context.Context, text string, lang string) (graph string, discourse string, err error)
+	Encode(ctx context.Context, graph string, lang string) (string, error)
+}
+
+var (
+	ErrNoInterp  = errors.New("no known concepts found")
+	ErrNoFixture = errors.New("no recorded fixture")
+)
+
+// NewLingProcessor builds the backend named in the config:
+// "glottie" (default), "local" or "fixture".
+func NewLingProcessor(kind string, address string, schemaPath string, fixturePath string) (LingProcessor, error) {
+	switch kind {
+	case "", "glottie":
+		return NewGlottieClient(address), nil
+	case "local":
+		return NewLocalLingProc(schemaPath)
+	case "fixture":
+		return NewFixtureLingProc(fixturePath)
+	default:
+		return nil, fmt.Errorf("unknown ling processor %q", kind)
+	}
+}
+
+// LocalLingProc is an offline rule-based processor: it spots class names
+// and their glosses from the loaded schemas in simple sentences.
+type LocalLingProc struct {
+	// lexicon maps a language onto normalized phrases and class names
+	lexicon map[string]map[string]string
+	glosses map[string]map[string]string // class -> lang -> gloss
+	maxLen  int                          // longest phrase in tokens
+}
+
+var (
+	classDeclRe  = regexp.MustCompile(`\{!class\s+([^\[\{\}\n]+)\s*(?:\[_gloss((?:\s*\{\w+\s*\{t\s+[^}]*\}\})+)\s*\])?`)
+	glossRe      = regexp.MustCompile(`\{(\w+)\s*\{t\s+([^}]*)\}\}`)
+	graphClassRe = regexp.MustCompile(`\{class\s+([^\[\{\}]+?)\s*[\{\[\}]`)
+
+	questionWords = map[string][]string{
+		"en": {"what", "who", "where", "when", "why", "how", "which"},
+		"ru": {"что", "кто", "где", "когда", "почему", "как", "какой", "какая", "какие"},
+	}
+)
+
+// NewLocalLingProc reads every *.gsl file of the schema directory.
+func NewLocalLingProc(schemaPath string) (*LocalLingProc, error) {
+	files, err := filepath.Glob(filepath.Join(schemaPath, "*.gsl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no schemas found in %s", schemaPath)
+	}
+	p := LocalLingProc{
+		lexicon: make(map[string]map[string]string),
+		glosses: make(map[string]map[string]string),
+	}
+	sort.Strings(files)
+	for _, filename := range files {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		p.addSchema(string(data))
+	}
+	return &p, nil
+}
+
+func (p *LocalLingProc) addSchema(gsl string) {
+	for _, m := range classDeclRe.FindAllStringSubmatch(gsl, -1) {
+		class := strings.Join(strings.Fields(m[1]), " ")
+		p.addPhrase(DefaultLang, class, class)
+		for _, g := range glossRe.FindAllStringSubmatch(m[2], -1) {
+			lang, gloss := g[1], strings.TrimSpace(g[2])
+			if p.glosses[class] == nil {
+				p.glosses[class] = make(map[string]string)
+			}
+			p.glosses[class][lang] = gloss
+			p.addPhrase(lang, gloss, class)
+		}
+	}
+}
+
+func (p *LocalLingProc) addPhrase(lang string, phrase string, class string) {
+	key := NormalizeMsg(phrase, lang)
+	if key == "" {
+		return
+	}
+	if p.lexicon[lang] == nil {
+		p.lexicon[lang] = make(map[string]string)
+	}
+	if _, ok := p.lexicon[lang][key]; !ok {
+		p.lexicon[lang][key] = class
+	}
+	if n := len(strings.Fields(key)); n > p.maxLen {
+		p.maxLen = n
+	}
+}
+
+// Decode picks the longest known phrases left to right.
+func (p *LocalLingProc) Decode(ctx context.Context, text string, lang string) (string, string, error) {
+	lang = baseLang(lang)
+	tokens := strings.Fields(NormalizeMsg(text, lang))
+	lexicon := p.lexicon[lang]
+
+	var graph strings.Builder
+	for i := 0; i < len(tokens); {
+		n := p.maxLen
+		if n > len(tokens)-i {
+			n = len(tokens) - i
+		}
+		for ; n > 0; n-- {
+			if class, ok := lexicon[strings.Join(tokens[i:i+n], " ")]; ok {
+				graph.WriteString("{class " + class + "}")
+				break
+			}
+		}
+		if n == 0 {
+			n = 1
+		}
+		i += n
+	}
+	if graph.Len() == 0 {
+		return "", "", ErrNoInterp
+	}
+	return graph.String(), discourseOf(text, tokens, lang), nil
+}
+
+func discourseOf(text string, tokens []string, lang string) string {
+	if strings.Contains(text, "?") {
+		return "query"
+	}
+	if len(tokens) > 0 {
+		for _, w := range questionWords[lang] {
+			if tokens[0] == w {
+				return "query"
+			}
+		}
+	}
+	return "stm"
+}
+
+// Encode names the classes of the graph in the target language.
+func (p *LocalLingProc) Encode(ctx context.Context, graph string, lang string) (string, error) {
+	lang = baseLang(lang)
+	var names []string
+	for _, m := range graphClassRe.FindAllStringSubmatch(graph, -1) {
+		class := strings.Join(strings.Fields(m[1]), " ")
+		if gloss, ok := p.glosses[class][lang]; ok {
+			class = gloss
+		}
+		names = append(names, class)
+	}
+	if len(names) == 0 {
+		return "", ErrNoInterp
+	}
+	return strings.Join(names, ", "), nil
+}
+
+// LingFixture is a set of recorded ling-proc exchanges.
+type LingFixture struct {
+	Decodes []DecodeFixture `json:"decode,omitempty"`
+	Encodes []EncodeFixture `json:"encode,omitempty"`
+}
+
+type DecodeFixture struct {
+	Text      string `json:"text"`
+	Lang      string `json:"lang"`
+	Graph     string `json:"graph"`
+	Discourse string `json:"discourse,omitempty"`
+}
+
+type EncodeFixture struct {
+	Graph string `json:"graph"`
+	Lang  string `json:"lang"`
+	Text  string `json:"text"`
+}
+
+// FixtureLingProc replays recorded exchanges; unknown input is an error.
+type FixtureLingProc struct {
+	decodes map[[2]string]DecodeFixture
+	encodes map[[2]string]EncodeFixture
+}
+
+func NewFixtureLingProc(filename string) (*FixtureLingProc, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var fixture LingFixture
+	if err := decodeJSON(data, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to read ling fixture %s: %w", filename, err)
+	}
+	return NewFixtureLingProcFrom(fixture), nil
+}
+
+func NewFixtureLingProcFrom(fixture LingFixture) *FixtureLingProc {
+	p := FixtureLingProc{
+		decodes: make(map[[2]string]DecodeFixture),
+		encodes: make(map[[2]string]EncodeFixture),
+	}
+	for _, d := range fixture.Decodes {
+		p.decodes[[2]string{d.Text, d.Lang}] = d
+	}
+	for _, e := range fixture.Encodes {
+		p.encodes[[2]string{e.Graph, e.Lang}] = e
+	}
+	return &p
+}
+
+func (p *FixtureLingProc) Decode(ctx context.Context, text string, lang string) (string, string, error) {
+	d, ok := p.decodes[[2]string{text, lang}]
+	if !ok {
+		return "", "", fmt.Errorf("%w: decode %q (%s)", ErrNoFixture, text, lang)
+	}
+	return d.Graph, d.Discourse, nil
+}
+
+func (p *FixtureLingProc) Encode(ctx context.Context, graph string, lang string) (string, error) {
+	e, ok := p.encodes[[2]string{graph, lang}]
+	if !ok {
+		return "", fmt.Errorf("%w: encode %q (%s)", ErrNoFixture, graph, lang)
+	}
+	return e.Text, nil
+}
+
+// RecordingLingProc passes calls through and keeps the successful ones,
+// so a session against a live service can be saved as a fixture.
+type RecordingLingProc struct {
+	LingProcessor
+
+	mu      sync.Mutex
+	fixture LingFixture
+}
+
+func (p *RecordingLingProc) Decode(ctx context.Context, text string, lang string) (string, string, error) {
+	graph, discourse, err := p.LingProcessor.Decode(ctx, text, lang)
+	if err == nil {
+		p.mu.Lock()
+		p.fixture.Decodes = append(p.fixture.Decodes, DecodeFixture{text, lang, graph, discourse})
+		p.mu.Unlock()
+	}
+	return graph, discourse, err
+}
+
+func (p *RecordingLingProc) Encode(ctx context.Context, graph string, lang string) (string, error) {
+	text, err := p.LingProcessor.Encode(ctx, graph, lang)
+	if err == nil {
+		p.mu.Lock()
+		p.fixture.Encodes = append(p.fixture.Encodes, EncodeFixture{graph, lang, text})
+		p.mu.Unlock()
+	}
+	return text, err
+}
+
+// Save writes everything recorded so far.
+func (p *RecordingLingProc) Save(filename string) error {
+	p.mu.Lock()
+	b, err := json.MarshalIndent(p.fixture, "", "  ")
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, b)
+}
@@ -0,0 +1,95 @@
+package knowdy
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalLingProcDecode(t *testing.T) {
+	p, err := NewLocalLingProc("testdata/system-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		text, lang, graph, discourse string
+	}{
+		{"I have an electric tea kettle", "en", "{class Electric Tea Kettle}", "stm"},
+		{"Where is the kettle?", "en", "{class Kettle}", "query"},
+		{"Banana and apple", "en", "{class Banana}{class Apple}", "stm"},
+		{"где мой электрочайник", "ru", "{class Electric Tea Kettle}", "query"},
+	}
+	for _, c := range cases {
+		graph, discourse, err := p.Decode(context.Background(), c.text, c.lang)
+		if err != nil {
+			t.Errorf("%q: %v", c.text, err)
+			continue
+		}
+		if graph != c.graph || discourse != c.discourse {
+			t.Errorf("%q: got %q %q, want %q %q", c.text, graph, discourse, c.graph, c.discourse)
+		}
+	}
+	if _, _, err := p.Decode(context.Background(), "lorem ipsum", "en"); !errors.Is(err, ErrNoInterp) {
+		t.Errorf("expected ErrNoInterp, got %v", err)
+	}
+}
+
+func TestLocalLingProcEncode(t *testing.T) {
+	p, err := NewLocalLingProc("testdata/system-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := p.Encode(context.Background(), "{class Kettle}{class Electric Tea Kettle}", "ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "чайник, электрочайник" {
+		t.Errorf("got %q", text)
+	}
+}
+
+func TestFixtureLingProcRecording(t *testing.T) {
+	local, err := NewLocalLingProc("testdata/system-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &RecordingLingProc{LingProcessor: local}
+	if _, _, err := rec.Decode(context.Background(), "banana", "en"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.Encode(context.Background(), "{class Kettle}", "ru"); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "ling.json")
+	if err := rec.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewLingProcessor("fixture", "", "", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _, err := p.Decode(context.Background(), "banana", "en")
+	if err != nil || graph != "{class Banana}" {
+		t.Errorf("got %q, %v", graph, err)
+	}
+	text, err := p.Encode(context.Background(), "{class Kettle}", "ru")
+	if err != nil || text != "чайник" {
+		t.Errorf("got %q, %v", text, err)
+	}
+	if _, _, err := p.Decode(context.Background(), "apple", "en"); !errors.Is(err, ErrNoFixture) {
+		t.Errorf("expected ErrNoFixture, got %v", err)
+	}
+}
+
+func TestNewLingProcessor(t *testing.T) {
+	if p, err := NewLingProcessor("", "localhost:8069", "", ""); err != nil {
+		t.Error(err)
+	} else if _, ok := p.(*GlottieClient); !ok {
+		t.Errorf("default backend: got %T", p)
+	}
+	if _, err := NewLingProcessor("oracle", "", "", ""); err == nil {
+		t.Error("expected an unknown backend error")
+	}
+}
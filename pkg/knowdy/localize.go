@@ -0,0 +1,112 @@
+package knowdy
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+var (
+	replySubj    = map[string]string{"en": "Reply", "ru": "Ответ"}
+	replyRestate = map[string]string{"en": "-- restate --", "ru": "-- переформулировка --"}
+)
+
+// localizer picks a single translation out of multi-language maps
+// according to the preferred languages, falling back to DefaultLang.
+type localizer struct {
+	prefs  []language.Tag
+	def    string
+	Locale string // locale of the first non-empty text selected
+
+	// picked caches the match for each key set seen, since the texts of
+	// a reply mostly share the same translations
+	picked map[string]string
+}
+
+func newLocalizer(prefs []language.Tag, def string) *localizer {
+	return &localizer{prefs: prefs, def: def, picked: make(map[string]string)}
+}
+
+// pick returns the key of the best translation available in m.
+func (l *localizer) pick(m map[string]string) string {
+	if len(m) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k != l.def {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := m[l.def]; ok {
+		// the first supported tag is what the matcher falls back to
+		keys = append([]string{l.def}, keys...)
+	}
+	set := strings.Join(keys, ",")
+	if k, ok := l.picked[set]; ok {
+		return k
+	}
+	k := l.match(keys)
+	l.picked[set] = k
+	return k
+}
+
+// match runs the language matcher over keys, the first being the fallback.
+func (l *localizer) match(keys []string) string {
+	tags := make([]language.Tag, len(keys))
+	for i, k := range keys {
+		tags[i] = language.Make(k)
+	}
+	_, idx, conf := language.NewMatcher(tags).Match(l.prefs...)
+	if conf == language.No {
+		return keys[0]
+	}
+	return keys[idx]
+}
+
+// text reduces m to its best translation.
+func (l *localizer) text(m map[string]string) map[string]string {
+	k := l.pick(m)
+	if k == "" {
+		return nil
+	}
+	if l.Locale == "" {
+		l.Locale = k
+	}
+	return map[string]string{k: m[k]}
+}
+
+func (l *localizer) menu(opts []MenuOption) []MenuOption {
+	if opts == nil {
+		return nil
+	}
+	out := make([]MenuOption, len(opts))
+	for i, opt := range opts {
+		out[i] = MenuOption{Id: opt.Id, Title: l.text(opt.Title)}
+	}
+	return out
+}
+
+func (l *localizer) resources(rs []Resource) []Resource {
+	if rs == nil {
+		return nil
+	}
+	out := make([]Resource, len(rs))
+	for i, r := range rs {
+		out[i] = Resource{Id: r.Id, ImgId: r.ImgId, Title: l.text(r.Title), Body: l.text(r.Body)}
+	}
+	return out
+}
+
+func (l *localizer) geoTags(tags []GeoTag) []GeoTag {
+	if tags == nil {
+		return nil
+	}
+	out := make([]GeoTag, len(tags))
+	for i, tag := range tags {
+		out[i] = GeoTag{Id: tag.Id, Lat: tag.Lat, Lng: tag.Lng, Title: l.text(tag.Title)}
+	}
+	return out
+}
@@ -0,0 +1,91 @@
+package knowdy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/globbie/aide/pkg/session"
+	"golang.org/x/text/language"
+)
+
+func TestLocalizerPick(t *testing.T) {
+	texts := map[string]string{"en": "Hello", "ru": "Привет", "de": "Hallo"}
+	cases := []struct {
+		prefs string
+		want  string
+	}{
+		{"ru-RU,ru;q=0.9", "ru"},
+		{"de-CH", "de"},
+		{"fr-FR,de;q=0.5", "de"},
+		{"ja", "en"},
+		{"", "en"},
+	}
+	for _, c := range cases {
+		prefs, _, _ := language.ParseAcceptLanguage(c.prefs)
+		l := newLocalizer(prefs, "en")
+		if got := l.pick(texts); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.prefs, got, c.want)
+		}
+	}
+}
+
+func TestLocalizerCachesKeySets(t *testing.T) {
+	l := newLocalizer([]language.Tag{language.Russian}, "en")
+	for i := 0; i < 3; i++ {
+		if got := l.pick(map[string]string{"en": "Go", "ru": "Вперёд"}); got != "ru" {
+			t.Fatalf("got %q", got)
+		}
+		if got := l.pick(map[string]string{"en": "Map", "de": "Karte"}); got != "en" {
+			t.Fatalf("got %q", got)
+		}
+	}
+	if len(l.picked) != 2 {
+		t.Errorf("expected one match per key set, got %v", l.picked)
+	}
+}
+
+func TestLocalizerMissingDefault(t *testing.T) {
+	l := newLocalizer([]language.Tag{language.Japanese}, "en")
+	got := l.text(map[string]string{"ru": "Привет"})
+	if got["ru"] != "Привет" || len(got) != 1 {
+		t.Errorf("expected the only translation, got %v", got)
+	}
+	if l.Locale != "ru" {
+		t.Errorf("served locale: got %q", l.Locale)
+	}
+}
+
+func TestBuildMsgReplyLocalized(t *testing.T) {
+	phase := ScriptPhase{
+		Body:      map[string]string{"en": "Welcome", "ru": "Добро пожаловать"},
+		Quest:     map[string]string{"en": "Where to?"},
+		Menu:      []MenuOption{{Id: "go", Title: map[string]string{"en": "Go", "ru": "Вперёд"}}},
+		Resources: []Resource{{Id: "r1", Title: map[string]string{"en": "Map", "ru": "Карта"}}},
+		GeoTags:   []GeoTag{{Id: "g1", Lat: 1, Lng: 2, Title: map[string]string{"en": "Park", "ru": "Парк"}}},
+	}
+	ses := &session.ChatSession{Langs: []language.Tag{language.Russian, language.English}}
+	out, err := buildMsgReply(ses, "greet", "main", phase, "ru", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply Message
+	if err := json.Unmarshal([]byte(out), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Locale != "ru" {
+		t.Errorf("served locale: got %q", reply.Locale)
+	}
+	if len(reply.Body) != 1 || reply.Body["ru"] == "" {
+		t.Errorf("body: got %v", reply.Body)
+	}
+	if reply.Quest["en"] == "" {
+		t.Errorf("quest should fall back to the default: got %v", reply.Quest)
+	}
+	if reply.Menu[0].Title["ru"] != "Вперёд" || reply.Resources[0].Title["ru"] != "Карта" ||
+		reply.GeoTags[0].Title["ru"] != "Парк" {
+		t.Errorf("nested titles not localized: %s", out)
+	}
+	if reply.Subj["ru"] == "" {
+		t.Errorf("subj: got %v", reply.Subj)
+	}
+}
@@ -0,0 +1,241 @@
+package knowdy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+)
+
+// Stemmer reduces a single normalized token to its stem.
+type Stemmer func(token string) string
+
+var (
+	stemmersMu sync.RWMutex
+	stemmers   = map[string]Stemmer{}
+)
+
+// RegisterStemmer installs a stemming hook for a base language ("en", "ru").
+// Triggers registered before the hook was installed keep their old keys,
+// so stemmers should be set up before the message cache is populated.
+func RegisterStemmer(lang string, stem Stemmer) {
+	stemmersMu.Lock()
+	defer stemmersMu.Unlock()
+	stemmers[baseLang(lang)] = stem
+}
+
+func lookupStemmer(lang string) Stemmer {
+	stemmersMu.RLock()
+	defer stemmersMu.RUnlock()
+	return stemmers[baseLang(lang)]
+}
+
+func baseLang(lang string) string {
+	i := strings.Index(lang, "-")
+	if i != -1 {
+		lang = lang[:i]
+	}
+	return strings.ToLower(lang)
+}
+
+// NormalizeMsg turns a user utterance or a trigger into an index key:
+// Unicode case folding, punctuation and symbols dropped, whitespace
+// collapsed, and every token passed through the language stemmer if any.
+func NormalizeMsg(msg string, lang string) string {
+	folded := cases.Fold().String(msg)
+	folded = strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return ' '
+		}
+		return r
+	}, folded)
+
+	tokens := strings.Fields(folded)
+	if stem := lookupStemmer(lang); stem != nil {
+		for i, tok := range tokens {
+			tokens[i] = stem(tok)
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// MsgMatch is a fuzzy match candidate from the message index.
+type MsgMatch struct {
+	Key     string
+	Score   float64
+	Interps []MsgInterp
+}
+
+// FuzzyMatch ranks the index keys against an already normalized message.
+// Keys scoring below threshold are dropped; the best match comes first.
+func (idx MsgIdx) FuzzyMatch(key string, threshold float64) []MsgMatch {
+	q := newMatchQuery(key)
+	var matches []MsgMatch
+	for k, interps := range idx {
+		score, ok := q.score(k, threshold)
+		if !ok {
+			continue
+		}
+		matches = append(matches, MsgMatch{k, score, interps})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Key < matches[j].Key
+	})
+	return matches
+}
+
+// matchQuery is a normalized message prepared for scoring many keys.
+type matchQuery struct {
+	runes  []rune
+	tokens map[string]bool
+
+	// scratch space reused across keys
+	key        []rune
+	seen       []string
+	prev, curr []int
+}
+
+func newMatchQuery(key string) *matchQuery {
+	q := matchQuery{runes: []rune(key), tokens: make(map[string]bool)}
+	for _, tok := range strings.Fields(key) {
+		q.tokens[tok] = true
+	}
+	return &q
+}
+
+// score is the better of the edit distance similarity and the token
+// overlap with k, in the range [0, 1]. The edit distance is at least the
+// difference in length, so it is only computed when that bound could
+// still beat both threshold and the token overlap, and given up on as
+// soon as it cannot.
+func (q *matchQuery) score(k string, threshold float64) (float64, bool) {
+	tokenScore := q.tokenOverlap(k)
+	n, kn := len(q.runes), utf8.RuneCountInString(k)
+	longest := n
+	if kn > longest {
+		longest = kn
+	}
+	if longest == 0 {
+		return 1, true
+	}
+	diff := n - kn
+	if diff < 0 {
+		diff = -diff
+	}
+	bound := 1 - float64(diff)/float64(longest)
+	if bound < threshold || bound <= tokenScore {
+		return tokenScore, tokenScore >= threshold
+	}
+	need := threshold
+	if tokenScore > need {
+		need = tokenScore
+	}
+	maxDist := int((1-need)*float64(longest) + 1e-9)
+	q.key = q.key[:0]
+	for _, r := range k {
+		q.key = append(q.key, r)
+	}
+	d := q.levenshteinWithin(q.key, maxDist)
+	if d > maxDist {
+		return tokenScore, tokenScore >= threshold
+	}
+	editScore := 1 - float64(d)/float64(longest)
+	if tokenScore > editScore {
+		editScore = tokenScore
+	}
+	return editScore, editScore >= threshold
+}
+
+// levenshteinWithin is the edit distance between the query and b, or
+// max+1 once it is known to exceed max.
+func (q *matchQuery) levenshteinWithin(b []rune, max int) int {
+	a := q.runes
+	if cap(q.prev) < len(b)+1 {
+		q.prev, q.curr = make([]int, len(b)+1), make([]int, len(b)+1)
+	}
+	prev, curr := q.prev[:len(b)+1], q.curr[:len(b)+1]
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		rowMin := curr[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if curr[j-1]+1 < d {
+				d = curr[j-1] + 1
+			}
+			curr[j] = d
+			if d < rowMin {
+				rowMin = d
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// tokenOverlap is the Jaccard index of the token sets of the query and k;
+// normalized keys are split on single spaces without allocating.
+func (q *matchQuery) tokenOverlap(k string) float64 {
+	if len(q.tokens) == 0 {
+		return 0
+	}
+	union := len(q.tokens)
+	common := 0
+	q.seen = q.seen[:0]
+	for rest := k; rest != ""; {
+		tok := rest
+		if i := strings.IndexByte(rest, ' '); i != -1 {
+			tok, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = ""
+		}
+		if tok == "" || q.seenToken(tok) {
+			continue
+		}
+		q.seen = append(q.seen, tok)
+		if q.tokens[tok] {
+			common++
+		} else {
+			union++
+		}
+	}
+	if len(q.seen) == 0 {
+		return 0
+	}
+	return float64(common) / float64(union)
+}
+
+// seenToken reports whether tok already occurred in the key being scored;
+// keys carry few tokens, so a linear scan beats a map here.
+func (q *matchQuery) seenToken(tok string) bool {
+	for _, t := range q.seen {
+		if t == tok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchScore scores two normalized strings without a threshold.
+func matchScore(a, b string) float64 {
+	score, _ := newMatchQuery(a).score(b, 0)
+	return score
+}
@@ -0,0 +1,142 @@
+package knowdy
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/globbie/aide/pkg/session"
+)
+
+func TestNormalizeMsg(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"Hello", "hello"},
+		{"  Hello   there!  ", "hello there"},
+		{"What's up?", "what s up"},
+		{"ПРИВЕТ, мир", "привет мир"},
+		{"Straße", "strasse"},
+		{"?!...", ""},
+	}
+	for _, c := range cases {
+		if got := NormalizeMsg(c.in, "en"); got != c.want {
+			t.Errorf("NormalizeMsg(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestNormalizeMsgStemmer(t *testing.T) {
+	RegisterStemmer("xx", func(tok string) string {
+		return strings.TrimSuffix(tok, "s")
+	})
+	if got := NormalizeMsg("Cats and Dogs", "xx-YY"); got != "cat and dog" {
+		t.Errorf("stemmed message: got %q", got)
+	}
+	if got := NormalizeMsg("Cats", "en"); got != "cats" {
+		t.Errorf("stemmer leaked into another language: got %q", got)
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	if s := matchScore("hello", "hello"); s != 1 {
+		t.Errorf("identical strings scored %v", s)
+	}
+	if s := matchScore("helo", "hello"); s < FuzzyMatchThreshold {
+		t.Errorf("one typo scored %v", s)
+	}
+	if s := matchScore("there hello", "hello there"); s != 1 {
+		t.Errorf("reordered tokens scored %v", s)
+	}
+	if s := matchScore("hi", "bye"); s >= FuzzyMatchThreshold {
+		t.Errorf("unrelated strings scored %v", s)
+	}
+}
+
+// benchIdx builds an index of n triggers of two to six words, like the
+// phrases of a large script set.
+func benchIdx(n int) MsgIdx {
+	words := strings.Fields("hello hi good morning evening where is the nearest " +
+		"museum metro station open today ticket price how much does it cost " +
+		"show me map route to red square tell about history please thanks bye")
+	idx := make(MsgIdx, n)
+	for i := 0; i < n; i++ {
+		var trigger []string
+		for j := 0; j < 2+i%5; j++ {
+			trigger = append(trigger, words[(i*7+j*13+i/len(words))%len(words)])
+		}
+		idx[strings.Join(trigger, " ")+" "+strconv.Itoa(i%97)] = nil
+	}
+	return idx
+}
+
+func TestFuzzyMatchPrefilter(t *testing.T) {
+	idx := benchIdx(2000)
+	msgs := []string{"", "helo", "where is the nearest metro"}
+	for k := range idx {
+		// known triggers with a typo and with a word dropped
+		msgs = append(msgs, k[1:], k[strings.Index(k, " ")+1:])
+		if len(msgs) > 40 {
+			break
+		}
+	}
+	total := 0
+	for _, msg := range msgs {
+		want := 0
+		for k := range idx {
+			q := newMatchQuery(msg)
+			n := len([]rune(msg))
+			if kn := len([]rune(k)); kn > n {
+				n = kn
+			}
+			score := 1.0
+			if n > 0 {
+				score = 1 - float64(q.levenshteinWithin([]rune(k), n))/float64(n)
+			}
+			if tok := q.tokenOverlap(k); tok > score {
+				score = tok
+			}
+			if score >= FuzzyMatchThreshold {
+				want++
+			}
+		}
+		got := idx.FuzzyMatch(msg, FuzzyMatchThreshold)
+		if len(got) != want {
+			t.Errorf("%q: got %d matches, want %d", msg, len(got), want)
+		}
+		total += want
+	}
+	if total == 0 {
+		t.Fatal("no message matched, the test proves nothing")
+	}
+}
+
+func BenchmarkFuzzyMatch(b *testing.B) {
+	idx := benchIdx(5000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.FuzzyMatch("where is the nearest metro station", FuzzyMatchThreshold)
+	}
+}
+
+func TestCacheLookupFuzzy(t *testing.T) {
+	scripts, msgs := writeTestCaches(t)
+	var s Shard
+	if err := s.PopulateScriptCache(scripts); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PopulateMsgCache(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	ses := &session.ChatSession{}
+	for _, msg := range []string{"hello!", "HELLO  ", "helo", "Hi."} {
+		if _, err := s.CacheLookup(ses, "main", msg, []string{"en"}); err != nil {
+			t.Errorf("%q: %v", msg, err)
+		}
+	}
+	if _, err := s.CacheLookup(ses, "main", "good morning", []string{"en"}); err == nil {
+		t.Error("expected a miss for an unrelated message")
+	}
+}
@@ -0,0 +1,464 @@
+package knowdy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// CommitWaitTimeout caps the wait for the authority; request handlers
+	// pass a context with a tighter deadline.
+	CommitWaitTimeout  = 10 * time.Second
+	CommitSendTimeout  = 7 * time.Second
+	CommitRetryBackoff = 500 * time.Millisecond
+	CommitMaxBackoff   = time.Minute
+
+	ErrCommitPending = errors.New("commit is pending")
+	ErrOutboxClosed  = errors.New("commit outbox is closed")
+)
+
+// CommitRejectedError is a refusal of the authority; such commits are
+// not retried.
+type CommitRejectedError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *CommitRejectedError) Error() string {
+	return fmt.Sprintf("commit rejected with %d: %s", e.StatusCode, e.Body)
+}
+
+// PendingCommit is a confirmed commit the authority has not accepted yet.
+type PendingCommit struct {
+	Key       string    `json:"key"`
+	GSL       string    `json:"gsl"`
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last-error,omitempty"`
+}
+
+type walRecord struct {
+	Op      string    `json:"op"` // add, ack or reject
+	Key     string    `json:"key"`
+	GSL     string    `json:"gsl,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+}
+
+type commitResult struct {
+	reply string
+	err   error
+}
+
+// CommitSender delivers a commit under its idempotency key.
+type CommitSender func(ctx context.Context, key string, gsl string) (string, error)
+
+// CommitOutbox appends confirmed commits to a write-ahead file and
+// forwards them one by one, in order, until the authority accepts them.
+type CommitOutbox struct {
+	path string
+	send CommitSender
+
+	mu      sync.Mutex
+	file    *os.File
+	pending []*PendingCommit
+	waiters map[string]chan commitResult
+	dead    int // acked and rejected records since the last compaction
+	started bool
+	closed  bool
+
+	wake    chan struct{} // a new commit for an idle outbox
+	flush   chan struct{} // cuts a retry backoff short
+	quit    chan struct{}
+	stopped chan struct{}
+}
+
+// OpenCommitOutbox replays the write-ahead file; commits left over from
+// a previous run are forwarded again once Run is called.
+func OpenCommitOutbox(path string, send CommitSender) (*CommitOutbox, error) {
+	o := CommitOutbox{
+		path:    path,
+		send:    send,
+		waiters: make(map[string]chan commitResult),
+		wake:    make(chan struct{}, 1),
+		flush:   make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := o.replay(); err != nil {
+		return nil, err
+	}
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+	if len(o.pending) > 0 {
+		log.Println("== commit outbox:", len(o.pending), "pending commits")
+	}
+	return &o, nil
+}
+
+func (o *CommitOutbox) replay() error {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	idx := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// a torn last write of a crash
+			log.Println("-- commit outbox", o.path, "line", line, "is corrupt:", err)
+			continue
+		}
+		switch rec.Op {
+		case "add":
+			idx[rec.Key] = len(o.pending)
+			o.pending = append(o.pending, &PendingCommit{Key: rec.Key, GSL: rec.GSL, Created: rec.Created})
+		case "ack", "reject":
+			if i, ok := idx[rec.Key]; ok {
+				o.pending[i] = nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read commit outbox %s: %w", o.path, err)
+	}
+	pending := o.pending[:0]
+	for _, pc := range o.pending {
+		if pc != nil {
+			pending = append(pending, pc)
+		}
+	}
+	o.pending = pending
+	return nil
+}
+
+// compact rewrites the file with the pending commits only and reopens it
+// for appending; it is called with mu held.
+func (o *CommitOutbox) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, pc := range o.pending {
+		if err := enc.Encode(walRecord{Op: "add", Key: pc.Key, GSL: pc.GSL, Created: pc.Created}); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(o.path, buf.Bytes()); err != nil {
+		return err
+	}
+	if o.file != nil {
+		o.file.Close()
+	}
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	o.file = f
+	o.dead = 0
+	return nil
+}
+
+// write appends a record and syncs it; it is called with mu held.
+func (o *CommitOutbox) write(rec walRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := o.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return o.file.Sync()
+}
+
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Append makes a commit durable and queues it for forwarding.
+func (o *CommitOutbox) Append(gsl string) (string, error) {
+	key, _, err := o.add(gsl, false)
+	return key, err
+}
+
+// add appends a commit; with wait set the outcome is delivered on the
+// returned channel, even when the authority replies before anyone reads.
+func (o *CommitOutbox) add(gsl string, wait bool) (string, chan commitResult, error) {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return "", nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return "", nil, ErrOutboxClosed
+	}
+	pc := PendingCommit{Key: key, GSL: gsl, Created: time.Now()}
+	if err := o.write(walRecord{Op: "add", Key: key, GSL: gsl, Created: pc.Created}); err != nil {
+		return "", nil, fmt.Errorf("failed to persist a commit: %w", err)
+	}
+	o.pending = append(o.pending, &pc)
+	var ch chan commitResult
+	if wait {
+		ch = make(chan commitResult, 1)
+		o.waiters[key] = ch
+	}
+
+	// a retry in progress keeps its backoff
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return key, ch, nil
+}
+
+// Commit appends a commit and waits for it to be accepted until ctx is
+// done, or for CommitWaitTimeout at most. When ctx is done first the
+// commit stays queued and ErrCommitPending is returned.
+func (o *CommitOutbox) Commit(ctx context.Context, gsl string) (string, string, error) {
+	key, ch, err := o.add(gsl, true)
+	if err != nil {
+		return "", "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, CommitWaitTimeout)
+	defer cancel()
+	select {
+	case res := <-ch:
+		return key, res.reply, res.err
+	case <-ctx.Done():
+		o.mu.Lock()
+		delete(o.waiters, key)
+		o.mu.Unlock()
+		return key, "", ErrCommitPending
+	}
+}
+
+// Pending lists the commits not accepted yet, oldest first.
+func (o *CommitOutbox) Pending() []PendingCommit {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pending := make([]PendingCommit, 0, len(o.pending))
+	for _, pc := range o.pending {
+		pending = append(pending, *pc)
+	}
+	return pending
+}
+
+func (o *CommitOutbox) head() (PendingCommit, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 {
+		return PendingCommit{}, false
+	}
+	return *o.pending[0], true
+}
+
+// finish records the outcome of the oldest commit and removes it.
+func (o *CommitOutbox) finish(op string, key string, res commitResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.write(walRecord{Op: op, Key: key}); err != nil {
+		// the commit is sent again after a restart
+		log.Println("-- failed to record a forwarded commit:", err)
+	}
+	o.pending = o.pending[1:]
+	o.dead++
+	if ch, ok := o.waiters[key]; ok {
+		ch <- res
+		delete(o.waiters, key)
+	}
+	if o.dead > 1000 && o.dead > len(o.pending) {
+		if err := o.compact(); err != nil {
+			log.Println("-- failed to compact the commit outbox:", err)
+		}
+	}
+}
+
+func (o *CommitOutbox) failed(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pc := o.pending[0]
+	pc.Attempts++
+	pc.LastError = err.Error()
+}
+
+// Run forwards pending commits until Close is called.
+func (o *CommitOutbox) Run() {
+	o.mu.Lock()
+	o.started = true
+	o.mu.Unlock()
+	defer close(o.stopped)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-o.quit
+		cancel()
+	}()
+
+	var backoff time.Duration
+	for {
+		pc, ok := o.head()
+		if !ok {
+			select {
+			case <-o.wake:
+				continue
+			case <-o.quit:
+				return
+			}
+		}
+		reply, err := o.send(ctx, pc.Key, pc.GSL)
+		var rejected *CommitRejectedError
+		switch {
+		case err == nil:
+			o.finish("ack", pc.Key, commitResult{reply, nil})
+			backoff = 0
+			continue
+		case errors.As(err, &rejected):
+			log.Println("-- commit", pc.Key, "rejected by the authority:", err)
+			o.finish("reject", pc.Key, commitResult{reply, err})
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		o.failed(err)
+		log.Println("-- failed to forward commit", pc.Key, ":", err)
+
+		backoff *= 2
+		if backoff == 0 {
+			backoff = CommitRetryBackoff
+		}
+		if backoff > CommitMaxBackoff {
+			backoff = CommitMaxBackoff
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-o.flush:
+			// a flush asks for another attempt right away
+			t.Stop()
+		case <-o.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// Flush waits for the pending commits to be forwarded. Commits still
+// pending when ctx is done stay in the file for the next run.
+func (o *CommitOutbox) Flush(ctx context.Context) error {
+	// cut a retry backoff short
+	select {
+	case o.flush <- struct{}{}:
+	default:
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		o.mu.Lock()
+		n := len(o.pending)
+		o.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d commits still pending: %w", n, ctx.Err())
+		}
+	}
+}
+
+// Close stops forwarding; pending commits stay in the file.
+func (o *CommitOutbox) Close() error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	started := o.started
+	o.mu.Unlock()
+
+	close(o.quit)
+	if started {
+		<-o.stopped
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
+
+// commitClient forwards commits to the authority; it only talks to that
+// one node, so a few kept-alive connections are enough.
+var commitClient = &http.Client{
+	Timeout: CommitSendTimeout,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   2 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        4,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// sendCommit posts a commit to the authority node under its key.
+func (s *Shard) sendCommit(ctx context.Context, key string, gsl string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, CommitSendTimeout)
+	defer cancel()
+
+	u := url.URL{Scheme: "http", Host: s.authority(), Path: "/gsl"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewBufferString(gsl))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Idempotency-Key", key)
+
+	resp, err := commitClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return string(body), nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return "", fmt.Errorf("authority replied %d: %s", resp.StatusCode, body)
+	default:
+		return string(body), &CommitRejectedError{resp.StatusCode, string(body)}
+	}
+}
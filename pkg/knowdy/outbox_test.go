@@ -0,0 +1,270 @@
+package knowdy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAuthority fails the first n sends, then accepts.
+type fakeAuthority struct {
+	mu       sync.Mutex
+	failures int
+	reject   string
+	accepted []string
+	keys     []string
+}
+
+func (a *fakeAuthority) send(ctx context.Context, key string, gsl string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = append(a.keys, key)
+	if gsl == a.reject {
+		return "bad", &CommitRejectedError{http.StatusBadRequest, "bad"}
+	}
+	if a.failures > 0 {
+		a.failures--
+		return "", errors.New("connection refused")
+	}
+	a.accepted = append(a.accepted, gsl)
+	return "ok " + gsl, nil
+}
+
+func (a *fakeAuthority) sent() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.accepted...)
+}
+
+func withFastRetries(t *testing.T) {
+	backoff, wait := CommitRetryBackoff, CommitWaitTimeout
+	CommitRetryBackoff, CommitWaitTimeout = time.Millisecond, 5*time.Second
+	t.Cleanup(func() { CommitRetryBackoff, CommitWaitTimeout = backoff, wait })
+}
+
+func TestOutboxRetries(t *testing.T) {
+	withFastRetries(t)
+	auth := &fakeAuthority{failures: 3}
+	o, err := OpenCommitOutbox(filepath.Join(t.TempDir(), "commits.wal"), auth.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Run()
+	defer o.Close()
+
+	key, reply, err := o.Commit(context.Background(), "{commit 1}")
+	if err != nil || reply != "ok {commit 1}" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	for _, k := range auth.keys {
+		if k != key {
+			t.Errorf("retries must reuse the idempotency key %s, got %s", key, k)
+		}
+	}
+	if len(o.Pending()) != 0 {
+		t.Errorf("accepted commit still pending: %v", o.Pending())
+	}
+}
+
+func TestOutboxRejected(t *testing.T) {
+	withFastRetries(t)
+	auth := &fakeAuthority{reject: "{bad}"}
+	o, err := OpenCommitOutbox(filepath.Join(t.TempDir(), "commits.wal"), auth.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Run()
+	defer o.Close()
+
+	_, _, err = o.Commit(context.Background(), "{bad}")
+	var rejected *CommitRejectedError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+	if _, reply, err := o.Commit(context.Background(), "{good}"); err != nil || reply != "ok {good}" {
+		t.Errorf("a rejection must not block later commits: %q, %v", reply, err)
+	}
+}
+
+func TestOutboxPending(t *testing.T) {
+	withFastRetries(t)
+	CommitWaitTimeout = 20 * time.Millisecond
+	auth := &fakeAuthority{failures: 1 << 30}
+	o, err := OpenCommitOutbox(filepath.Join(t.TempDir(), "commits.wal"), auth.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Run()
+	defer o.Close()
+
+	key, _, err := o.Commit(context.Background(), "{commit 1}")
+	if !errors.Is(err, ErrCommitPending) {
+		t.Fatalf("expected ErrCommitPending, got %v", err)
+	}
+	pending := o.Pending()
+	if len(pending) != 1 || pending[0].Key != key || pending[0].Attempts == 0 || pending[0].LastError == "" {
+		t.Errorf("unexpected pending commits %+v", pending)
+	}
+}
+
+func TestOutboxReplay(t *testing.T) {
+	withFastRetries(t)
+	path := filepath.Join(t.TempDir(), "commits.wal")
+
+	// nothing is forwarded without Run
+	o, err := OpenCommitOutbox(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, gsl := range []string{"{commit 1}", "{commit 2}", "{commit 3}"} {
+		if _, err := o.Append(gsl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.Close()
+
+	// simulate a torn write and an earlier ack of the first commit
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	first := strings.SplitN(string(b), "\n", 2)[0]
+	key := first[strings.Index(first, `"key":"`)+7:]
+	key = key[:strings.Index(key, `"`)]
+	f.WriteString(`{"op":"ack","key":"` + key + "\"}\n{\"op\":\"add\",\"ke")
+	f.Close()
+
+	auth := &fakeAuthority{}
+	o, err = OpenCommitOutbox(path, auth.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(o.Pending()); n != 2 {
+		t.Fatalf("expected 2 replayed commits, got %d", n)
+	}
+	go o.Run()
+	defer o.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(o.Pending()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	sent := auth.sent()
+	if len(sent) != 2 || sent[0] != "{commit 2}" || sent[1] != "{commit 3}" {
+		t.Errorf("replayed commits forwarded out of order: %v", sent)
+	}
+}
+
+func TestSendCommit(t *testing.T) {
+	var gotKey string
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("Idempotency-Key")
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	s := Shard{KnowdyAddress: ts.URL[7:]}
+	if _, err := s.sendCommit(context.Background(), "k1", "{commit}"); err != nil || gotKey != "k1" {
+		t.Errorf("got key %q, %v", gotKey, err)
+	}
+	status = http.StatusServiceUnavailable
+	_, err := s.sendCommit(context.Background(), "k2", "{commit}")
+	var rejected *CommitRejectedError
+	if err == nil || errors.As(err, &rejected) {
+		t.Errorf("a 503 should be retried, got %v", err)
+	}
+	status = http.StatusBadRequest
+	if _, err := s.sendCommit(context.Background(), "k3", "{commit}"); !errors.As(err, &rejected) {
+		t.Errorf("a 400 should be a rejection, got %v", err)
+	}
+}
+
+func TestOutboxFlush(t *testing.T) {
+	withFastRetries(t)
+	CommitRetryBackoff = time.Hour
+	auth := &fakeAuthority{failures: 1}
+	o, err := OpenCommitOutbox(filepath.Join(t.TempDir(), "commits.wal"), auth.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Append("{commit 1}"); err != nil {
+		t.Fatal(err)
+	}
+	go o.Run()
+	defer o.Close()
+
+	// the first attempt fails and the retry waits for an hour
+	deadline := time.Now().Add(5 * time.Second)
+	for o.Pending()[0].Attempts == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := o.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sent := auth.sent(); len(sent) != 1 {
+		t.Errorf("expected the commit to be forwarded, got %v", sent)
+	}
+}
+
+func TestOutboxImmediateReply(t *testing.T) {
+	o, err := OpenCommitOutbox(filepath.Join(t.TempDir(), "commits.wal"),
+		func(ctx context.Context, key string, gsl string) (string, error) {
+			return "ok " + gsl, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Run()
+	defer o.Close()
+
+	// the reply may come before Commit starts waiting for it
+	for i := 0; i < 200; i++ {
+		if _, reply, err := o.Commit(context.Background(), "{commit}"); err != nil || reply != "ok {commit}" {
+			t.Fatalf("commit %d: got %q, %v", i, reply, err)
+		}
+	}
+}
+
+func TestOutboxAppendKeepsBackoff(t *testing.T) {
+	withFastRetries(t)
+	CommitRetryBackoff = time.Hour
+	auth := &fakeAuthority{failures: 1 << 30}
+	o, err := OpenCommitOutbox(filepath.Join(t.TempDir(), "commits.wal"), auth.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Run()
+	defer o.Close()
+
+	if _, err := o.Append("{commit 0}"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for o.Pending()[0].Attempts == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i <= 20; i++ {
+		if _, err := o.Append("{commit}"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	auth.mu.Lock()
+	attempts := len(auth.keys)
+	auth.mu.Unlock()
+	if attempts != 1 {
+		t.Errorf("new commits cut the backoff short: %d attempts", attempts)
+	}
+}
@@ -0,0 +1,253 @@
+package knowdy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ShardStatusPath = "/status"
+	// ShardPollInterval and PlacementShards are the defaults of a new
+	// registry.
+	ShardPollInterval = 10 * time.Second
+	PlacementShards   = []string{"public"}
+	// ShardDownAfter is the number of failed polls in a row that mark a
+	// peer down, so that a single lost reply does not take it out.
+	ShardDownAfter = 3
+
+	ErrUnknownShard = errors.New("unknown shard")
+	ErrShardDown    = errors.New("shard is unavailable")
+	ErrNoCapacity   = errors.New("no shard has capacity for a new session")
+)
+
+// ShardLoad is the status reply of a knowdy peer.
+type ShardLoad struct {
+	MaxCapacity int `json:"max-capacity"`
+	Capacity    int `json:"capacity"`
+}
+
+// ShardRegistry keeps the health and the load of the peer shards, places
+// new sessions and routes requests of existing ones.
+type ShardRegistry struct {
+	// Placement are the peers new sessions may be placed on and
+	// PollInterval is how often Run polls; both are set before use.
+	Placement    []string
+	PollInterval time.Duration
+
+	client *http.Client
+
+	mu     sync.RWMutex
+	shards map[string]*ShardInfo
+	order  []string
+}
+
+// PeerShardInfo names the peers after the knowdy service:
+// <service>-<shard>, listening on the port of the knowdy address (80 when
+// it has none).
+func PeerShardInfo(serviceName string, knowdyAddress string, names []string) []ShardInfo {
+	port := "80"
+	if _, p, err := net.SplitHostPort(knowdyAddress); err == nil && p != "" {
+		port = p
+	}
+	var peers []ShardInfo
+	for _, name := range names {
+		peers = append(peers, ShardInfo{
+			Name:    name,
+			Address: net.JoinHostPort(serviceName+"-"+name, port),
+			Healthy: true,
+		})
+	}
+	return peers
+}
+
+func NewShardRegistry(peers []ShardInfo) *ShardRegistry {
+	r := ShardRegistry{
+		Placement:    append([]string(nil), PlacementShards...),
+		PollInterval: ShardPollInterval,
+		client:       &http.Client{Timeout: 3 * time.Second},
+		shards:       make(map[string]*ShardInfo),
+	}
+	for i := range peers {
+		si := peers[i]
+		if _, ok := r.shards[si.Name]; ok {
+			continue
+		}
+		r.shards[si.Name] = &si
+		r.order = append(r.order, si.Name)
+	}
+	return &r
+}
+
+// SetPeers replaces the configured peers. Peers kept by name keep their
+// health and load until the next poll.
+func (r *ShardRegistry) SetPeers(peers []ShardInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	shards := make(map[string]*ShardInfo)
+	var order []string
+	for i := range peers {
+		si := peers[i]
+		if _, ok := shards[si.Name]; ok {
+			continue
+		}
+		if prev, ok := r.shards[si.Name]; ok && prev.Address == si.Address {
+			si = *prev
+		}
+		shards[si.Name] = &si
+		order = append(order, si.Name)
+	}
+	r.shards, r.order = shards, order
+}
+
+// List returns a copy of every peer in the configured order.
+func (r *ShardRegistry) List() []ShardInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	peers := make([]ShardInfo, 0, len(r.order))
+	for _, name := range r.order {
+		peers = append(peers, *r.shards[name])
+	}
+	return peers
+}
+
+// Route returns the peer hosting the sessions of a token's shard claim.
+func (r *ShardRegistry) Route(name string) (ShardInfo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	si, ok := r.shards[name]
+	if !ok {
+		return ShardInfo{}, fmt.Errorf("%w: %q", ErrUnknownShard, name)
+	}
+	if !si.Healthy {
+		return *si, fmt.Errorf("%w: %s", ErrShardDown, name)
+	}
+	return *si, nil
+}
+
+// Place picks the healthy placement shard with the largest share of free
+// capacity; peers that have not reported their capacity come last. The
+// chosen shard is charged with the new session until the next poll.
+func (r *ShardRegistry) Place() (ShardInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var candidates []*ShardInfo
+	for _, name := range r.Placement {
+		si, ok := r.shards[name]
+		if !ok || !si.Healthy {
+			continue
+		}
+		if si.MaxCapacity > 0 && si.Capacity >= si.MaxCapacity {
+			continue
+		}
+		candidates = append(candidates, si)
+	}
+	if len(candidates) == 0 {
+		return ShardInfo{}, ErrNoCapacity
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return freeShare(candidates[i]) > freeShare(candidates[j])
+	})
+	si := candidates[0]
+	si.Capacity++
+	return *si, nil
+}
+
+func freeShare(si *ShardInfo) float64 {
+	if si.MaxCapacity <= 0 {
+		return -1
+	}
+	return float64(si.MaxCapacity-si.Capacity) / float64(si.MaxCapacity)
+}
+
+// Poll asks every peer for its status concurrently.
+func (r *ShardRegistry) Poll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, si := range r.List() {
+		wg.Add(1)
+		go func(name string, address string) {
+			defer wg.Done()
+			load, err := r.fetchLoad(ctx, address)
+			r.update(name, load, err)
+		}(si.Name, si.Address)
+	}
+	wg.Wait()
+}
+
+// Run polls the peers every PollInterval until ctx is done.
+func (r *ShardRegistry) Run(ctx context.Context) {
+	r.Poll(ctx)
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Poll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *ShardRegistry) fetchLoad(ctx context.Context, address string) (ShardLoad, error) {
+	var load ShardLoad
+	u := url.URL{Scheme: "http", Host: address, Path: ShardStatusPath}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return load, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return load, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return load, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return load, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, &load); err != nil {
+		return load, fmt.Errorf("invalid status reply: %w", err)
+	}
+	return load, nil
+}
+
+func (r *ShardRegistry) update(name string, load ShardLoad, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	si, ok := r.shards[name]
+	if !ok {
+		return
+	}
+	si.CheckedAt = time.Now()
+	if err != nil {
+		si.Failures++
+		si.Err = err.Error()
+		if si.Healthy && si.Failures >= ShardDownAfter {
+			log.Println("-- shard", name, "is down:", err)
+			si.Healthy = false
+		}
+		return
+	}
+	if !si.Healthy {
+		log.Println("== shard", name, "is back up")
+	}
+	si.Healthy = true
+	si.Failures = 0
+	si.Err = ""
+	si.MaxCapacity = load.MaxCapacity
+	si.Capacity = load.Capacity
+}
@@ -0,0 +1,180 @@
+package knowdy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/globbie/aide/pkg/session"
+)
+
+func statusServer(t *testing.T, status int, load string) string {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != ShardStatusPath {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, load)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL[7:]
+}
+
+func TestPlaceByCapacity(t *testing.T) {
+	r := NewShardRegistry([]ShardInfo{
+		{Name: "a", Healthy: true, MaxCapacity: 10, Capacity: 8},
+		{Name: "b", Healthy: true, MaxCapacity: 100, Capacity: 50},
+		{Name: "c", Healthy: true},
+		{Name: "secure", Healthy: true, MaxCapacity: 100},
+	})
+	r.Placement = []string{"a", "b", "c"}
+
+	si, err := r.Place()
+	if err != nil || si.Name != "b" {
+		t.Fatalf("got %v %v, want b", si.Name, err)
+	}
+	if si.Capacity != 51 {
+		t.Errorf("placement should charge the shard, capacity %d", si.Capacity)
+	}
+}
+
+func TestPlaceSkipsFullAndDown(t *testing.T) {
+	r := NewShardRegistry([]ShardInfo{
+		{Name: "a", Healthy: true, MaxCapacity: 1, Capacity: 1},
+		{Name: "b", Healthy: false, MaxCapacity: 10},
+		{Name: "c", Healthy: true},
+	})
+	r.Placement = []string{"a", "b", "c"}
+	si, err := r.Place()
+	if err != nil || si.Name != "c" {
+		t.Fatalf("got %v %v, want c", si.Name, err)
+	}
+
+	r = NewShardRegistry([]ShardInfo{{Name: "a", Healthy: true, MaxCapacity: 1}})
+	r.Placement = []string{"a"}
+	if _, err := r.Place(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Place(); !errors.Is(err, ErrNoCapacity) {
+		t.Errorf("expected ErrNoCapacity, got %v", err)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	r := NewShardRegistry([]ShardInfo{
+		{Name: "public", Address: "knowdy-public", Healthy: true},
+		{Name: "secure", Address: "knowdy-secure"},
+	})
+	if si, err := r.Route("public"); err != nil || si.Address != "knowdy-public" {
+		t.Errorf("got %v %v", si, err)
+	}
+	if _, err := r.Route("secure"); !errors.Is(err, ErrShardDown) {
+		t.Errorf("expected ErrShardDown, got %v", err)
+	}
+	if _, err := r.Route("nope"); !errors.Is(err, ErrUnknownShard) {
+		t.Errorf("expected ErrUnknownShard, got %v", err)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	r := NewShardRegistry([]ShardInfo{
+		{Name: "up", Address: statusServer(t, http.StatusOK, `{"max-capacity":100,"capacity":42}`), Healthy: true},
+		{Name: "failing", Address: statusServer(t, http.StatusInternalServerError, ""), Healthy: true},
+		{Name: "garbled", Address: statusServer(t, http.StatusOK, "{"), Healthy: true},
+	})
+	r.Poll(context.Background())
+	for _, si := range r.List()[1:] {
+		if !si.Healthy || si.Failures != 1 || si.Err == "" {
+			t.Errorf("%s should survive a single failed poll: %+v", si.Name, si)
+		}
+	}
+	for i := 1; i < ShardDownAfter; i++ {
+		r.Poll(context.Background())
+	}
+
+	peers := r.List()
+	if !peers[0].Healthy || peers[0].MaxCapacity != 100 || peers[0].Capacity != 42 {
+		t.Errorf("unexpected status of up: %+v", peers[0])
+	}
+	for _, si := range peers[1:] {
+		if si.Healthy || si.Err == "" || si.CheckedAt.IsZero() {
+			t.Errorf("%s should be down: %+v", si.Name, si)
+		}
+	}
+}
+
+func TestPeerShardInfo(t *testing.T) {
+	peers := PeerShardInfo("knowdy", "127.0.0.1:8088", []string{"default", "public"})
+	if len(peers) != 2 || peers[1].Address != "knowdy-public:8088" || !peers[1].Healthy {
+		t.Errorf("unexpected peers %+v", peers)
+	}
+	if peers := PeerShardInfo("knowdy", "", []string{"public"}); peers[0].Address != "knowdy-public:80" {
+		t.Errorf("unexpected peers %+v", peers)
+	}
+}
+
+func TestSetPeers(t *testing.T) {
+	r := NewShardRegistry([]ShardInfo{
+		{Name: "public", Address: "knowdy-public:80", MaxCapacity: 100, Capacity: 42},
+		{Name: "secure", Address: "knowdy-secure", Healthy: true},
+	})
+	r.SetPeers(PeerShardInfo("knowdy", "", []string{"public", "extra"}))
+
+	peers := r.List()
+	if len(peers) != 2 || peers[0].Name != "public" || peers[1].Name != "extra" {
+		t.Fatalf("unexpected peers %+v", peers)
+	}
+	if peers[0].Healthy || peers[0].Capacity != 42 {
+		t.Errorf("a kept peer should keep its status: %+v", peers[0])
+	}
+	if _, err := r.Route("secure"); !errors.Is(err, ErrUnknownShard) {
+		t.Errorf("a removed peer should be unknown, got %v", err)
+	}
+}
+
+func TestCreateChatSessionWithoutCapacity(t *testing.T) {
+	report, err := ioutil.ReadFile("testdata/registration-report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var registered int
+	authority := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registered++
+		_, _ = w.Write(report)
+	}))
+	defer authority.Close()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the only placement shard is down
+	s := Shard{
+		Name:          "default",
+		KnowdyAddress: authority.Listener.Addr().String(),
+		PeerShards:    NewShardRegistry([]ShardInfo{{Name: "public", Address: "knowdy-public:80"}}),
+	}
+	if _, _, err := s.CreateChatSession(&session.ChatSession{}, key); !errors.Is(err, ErrNoCapacity) {
+		t.Fatalf("expected ErrNoCapacity, got %v", err)
+	}
+	if registered != 0 {
+		t.Error("a user was registered without a shard")
+	}
+
+	// a standalone instance hosts the session itself
+	s.Name = ""
+	ses := &session.ChatSession{}
+	if _, _, err := s.CreateChatSession(ses, key); err != nil {
+		t.Fatal(err)
+	}
+	if ses.ShardId != "" || ses.UserId != "15" || registered != 1 {
+		t.Errorf("expected a session on the standalone instance, got %+v", ses)
+	}
+}
@@ -0,0 +1,60 @@
+package knowdy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrNoUserId = errors.New("no user instance in the registration report")
+
+// RegistrationReport is what the engine reports on a new user.
+type RegistrationReport struct {
+	UserId   string `json:"uid"`
+	CommitId string `json:"commit,omitempty"`
+}
+
+// registrationReply is the JSON commit report of the registration task:
+//
+//	{"commit":{"_id":"7"},"class":{"_name":"User","!inst":{"_id":"15"}}}
+type registrationReply struct {
+	Commit struct {
+		Id string `json:"_id"`
+	} `json:"commit"`
+	Class struct {
+		Name string `json:"_name"`
+		Inst struct {
+			Id string `json:"_id"`
+		} `json:"!inst"`
+	} `json:"class"`
+}
+
+// ParseRegistrationReport reads the uid and the commit id from the JSON
+// commit report of a new user. Anything but the expected shape is an
+// error, so that a change of the engine output is noticed at once.
+func ParseRegistrationReport(report string) (RegistrationReport, error) {
+	var rr RegistrationReport
+	var reply registrationReply
+	dec := json.NewDecoder(strings.NewReader(report))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&reply); err != nil {
+		return rr, fmt.Errorf("invalid registration report: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return rr, errors.New("invalid registration report: trailing data")
+	}
+	if reply.Class.Name != "User" {
+		return rr, fmt.Errorf("%w: class %q", ErrNoUserId, reply.Class.Name)
+	}
+	if reply.Class.Inst.Id == "" || reply.Class.Inst.Id == "_" {
+		return rr, ErrNoUserId
+	}
+	if reply.Commit.Id == "" {
+		return rr, errors.New("invalid registration report: no commit id")
+	}
+	rr.UserId = reply.Class.Inst.Id
+	rr.CommitId = reply.Commit.Id
+	return rr, nil
+}
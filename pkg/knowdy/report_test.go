@@ -0,0 +1,46 @@
+package knowdy
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseRegistrationReport(t *testing.T) {
+	report, err := ioutil.ReadFile("testdata/registration-report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := ParseRegistrationReport(string(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.UserId != "15" || rr.CommitId != "7" {
+		t.Errorf("got %+v", rr)
+	}
+}
+
+func TestParseRegistrationReportErrors(t *testing.T) {
+	for _, report := range []string{
+		`{"commit":{"_id":"7"},"class":{"_name":"Message","!inst":{"_id":"15"}}}`,
+		`{"commit":{"_id":"7"},"class":{"_name":"User","!inst":{"_id":"_"}}}`,
+		`{"commit":{"_id":"7"},"class":{"_name":"User"}}`,
+	} {
+		if _, err := ParseRegistrationReport(report); !errors.Is(err, ErrNoUserId) {
+			t.Errorf("%q: expected ErrNoUserId, got %v", report, err)
+		}
+	}
+	for _, report := range []string{
+		``,
+		`{"class": `,
+		`{commit 11{class User{!inst 22}}}`,
+		`{"commit":{"_id":7},"class":{"_name":"User","!inst":{"_id":"15"}}}`,
+		`{"commit":{"_id":"7"},"class":{"_name":"User","!inst":{"_id":"15"}},"extra":1}`,
+		`{"class":{"_name":"User","!inst":{"_id":"15"}}}`,
+		`{"commit":{"_id":"7"},"class":{"_name":"User","!inst":{"_id":"15"}}} {}`,
+	} {
+		if _, err := ParseRegistrationReport(report); err == nil || errors.Is(err, ErrNoUserId) {
+			t.Errorf("%q: expected an invalid report, got %v", report, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package knowdy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ThumbWidths are the only thumbnail sizes generated on request.
+	ThumbWidths = []int{64, 128, 256, 512}
+
+	ErrBadImageId    = errors.New("invalid image id")
+	ErrBadThumbWidth = errors.New("unsupported thumbnail width")
+)
+
+// ResourceStore is a directory-backed resource catalogue:
+//
+//	<dir>/<id>.json          resource metadata keyed by Resource.Id
+//	<dir>/img/<imgId>        original images
+//	<dir>/thumbs/<w>/<imgId> thumbnails, generated on first request
+type ResourceStore struct {
+	dir       string
+	mu        sync.RWMutex
+	resources map[string]Resource
+}
+
+func NewResourceStore(dir string) (*ResourceStore, error) {
+	rs := ResourceStore{dir: dir}
+	if err := rs.Reload(); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// Reload rereads all resource metadata from the store directory.
+func (rs *ResourceStore) Reload() error {
+	files, err := filepath.Glob(filepath.Join(rs.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	resources := make(map[string]Resource, len(files))
+	for _, filename := range files {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		var r Resource
+		if err := decodeJSON(data, &r); err != nil {
+			return fmt.Errorf("failed to read resource %s: %w", filename, err)
+		}
+		id := strings.TrimSuffix(filepath.Base(filename), ".json")
+		if r.Id == "" {
+			r.Id = id
+		}
+		if r.Id != id {
+			return fmt.Errorf("resource %s: id %q does not match the file name", filename, r.Id)
+		}
+		resources[r.Id] = r
+	}
+
+	rs.mu.Lock()
+	rs.resources = resources
+	rs.mu.Unlock()
+	return nil
+}
+
+func (rs *ResourceStore) Get(id string) (Resource, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	r, ok := rs.resources[id]
+	return r, ok
+}
+
+// Resolve fills the fields a script left empty from the catalogue entry
+// with the same id; unknown resources are passed through as is.
+func (rs *ResourceStore) Resolve(resources []Resource) []Resource {
+	if rs == nil || resources == nil {
+		return resources
+	}
+	out := make([]Resource, len(resources))
+	for i, r := range resources {
+		if entry, ok := rs.Get(r.Id); ok {
+			if r.ImgId == "" {
+				r.ImgId = entry.ImgId
+			}
+			if r.Title == nil {
+				r.Title = entry.Title
+			}
+			if r.Body == nil {
+				r.Body = entry.Body
+			}
+		}
+		out[i] = r
+	}
+	return out
+}
+
+// ImagePath returns the file to serve for an image; a non-zero width
+// selects a thumbnail, generating it on first use.
+func (rs *ResourceStore) ImagePath(imgId string, width int) (string, error) {
+	if imgId == "" || imgId != filepath.Base(imgId) || strings.HasPrefix(imgId, ".") {
+		return "", ErrBadImageId
+	}
+	orig := filepath.Join(rs.dir, "img", imgId)
+	if width == 0 {
+		return orig, nil
+	}
+	if !validThumbWidth(width) {
+		return "", ErrBadThumbWidth
+	}
+
+	thumb := filepath.Join(rs.dir, "thumbs", strconv.Itoa(width), imgId)
+	if _, err := os.Stat(thumb); err == nil {
+		return thumb, nil
+	}
+	if err := makeThumbnail(orig, thumb, width); err != nil {
+		return "", err
+	}
+	return thumb, nil
+}
+
+func validThumbWidth(width int) bool {
+	for _, w := range ThumbWidths {
+		if w == width {
+			return true
+		}
+	}
+	return false
+}
+
+func makeThumbnail(orig string, thumb string, width int) error {
+	f, err := os.Open(orig)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	src, format, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("failed to decode image %s: %w", orig, err)
+	}
+	dst := scaleToWidth(src, width)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	case "gif":
+		err = gif.Encode(&buf, dst, nil)
+	default:
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(thumb), 0755); err != nil {
+		return err
+	}
+	log.Println("== thumbnail generated:", thumb)
+	return writeFileAtomic(thumb, buf.Bytes())
+}
+
+// scaleToWidth downsamples by averaging the source pixels covered by
+// every destination pixel; images narrower than width are kept as is.
+func scaleToWidth(src image.Image, width int) image.Image {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	if sw <= width || sw == 0 {
+		return src
+	}
+	height := sh * width / sw
+	if height == 0 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := sb.Min.Y+y*sh/height, sb.Min.Y+(y+1)*sh/height
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := sb.Min.X+x*sw/width, sb.Min.X+(x+1)*sw/width
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
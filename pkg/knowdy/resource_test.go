@@ -0,0 +1,110 @@
+package knowdy
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestStore(t *testing.T) string {
+	dir := t.TempDir()
+	meta := `{"id": "park", "img": "park.png", "title": {"en": "Park", "ru": "Парк"}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "park.json"), []byte(meta), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "img"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 300, 150))
+	for y := 0; y < 150; y++ {
+		for x := 0; x < 300; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	f, err := os.Create(filepath.Join(dir, "img", "park.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestResourceStore(t *testing.T) {
+	rs, err := NewResourceStore(writeTestStore(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := rs.Get("park")
+	if !ok || r.ImgId != "park.png" {
+		t.Fatalf("got %v", r)
+	}
+
+	resolved := rs.Resolve([]Resource{{Id: "park"}, {Id: "unknown", ImgId: "x.png"}})
+	if resolved[0].ImgId != "park.png" || resolved[0].Title["ru"] != "Парк" {
+		t.Errorf("catalogue entry not resolved: %v", resolved[0])
+	}
+	if resolved[1].ImgId != "x.png" {
+		t.Errorf("unknown resource changed: %v", resolved[1])
+	}
+}
+
+func TestResourceStoreThumbnail(t *testing.T) {
+	rs, err := NewResourceStore(writeTestStore(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := rs.ImagePath("park.png", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg, err := png.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 128 || cfg.Height != 64 {
+		t.Errorf("thumbnail size: got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	if _, err := rs.ImagePath("park.png", 100); err != ErrBadThumbWidth {
+		t.Errorf("expected ErrBadThumbWidth, got %v", err)
+	}
+	for _, id := range []string{"../park.json", ".hidden", ""} {
+		if _, err := rs.ImagePath(id, 0); err != ErrBadImageId {
+			t.Errorf("%q: expected ErrBadImageId, got %v", id, err)
+		}
+	}
+	if _, err := rs.ImagePath("missing.png", 64); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+}
+
+func TestBuildMsgReplyMaxResources(t *testing.T) {
+	phase := ScriptPhase{Body: map[string]string{"en": "Look"}}
+	for i := 0; i < MaxResources+3; i++ {
+		phase.Resources = append(phase.Resources, Resource{Id: "r"})
+	}
+	out, err := buildMsgReply(nil, "greet", "main", phase, "en", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply Message
+	if err := json.Unmarshal([]byte(out), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Resources) != MaxResources {
+		t.Errorf("got %d resources, want %d", len(reply.Resources), MaxResources)
+	}
+}
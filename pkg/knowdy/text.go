@@ -1,58 +1,51 @@
 package knowdy
 
 import (
-	"bytes"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"net/url"
-	"time"
+	"context"
+	"errors"
+	"strings"
 )
 
-func (s *Shard) DecodeText(text string, lang string) (string, string, error) {
-	u := url.URL{Scheme: "http", Host: s.LingProcAddress, Path: "/decode"}
-	parameters := url.Values{}
-	parameters.Add("t", text)
-	parameters.Add("lang", lang)
-	u.RawQuery = parameters.Encode()
-
-	var netClient = &http.Client{
-		Timeout: time.Second * 7,
-	}
-
-	resp, err := netClient.Get(u.String())
-	if err != nil {
-		log.Println(err.Error())
-		return "", "", err
-	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-
-	dt := resp.Header.Get("GLT-Discourse-Type")
-	// if dt != "" {
-	//	log.Println("discourse type: ", dt)
-	// }
-	return string(body), dt, nil
+var ErrEmptyGraph = errors.New("empty graph")
+
+// lingProc returns the linguistic processor, falling back to a Glottie
+// client for shards built without New.
+func (s *Shard) lingProc() LingProcessor {
+	s.lingProcOnce.Do(func() {
+		if s.LingProc == nil {
+			s.LingProc = NewGlottieClient(s.LingProcAddress)
+		}
+	})
+	return s.LingProc
 }
 
-func (s *Shard) EncodeText(graph string, lang string) (string, error) {
-	u := url.URL{Scheme: "http", Host: s.LingProcAddress, Path: "/encode"}
-	parameters := url.Values{}
-	parameters.Add("cs", lang)
-	u.RawQuery = parameters.Encode()
+func (s *Shard) DecodeText(ctx context.Context, text string, lang string) (string, string, error) {
+	return s.lingProc().Decode(ctx, text, lang)
+}
 
-	var netClient = &http.Client{
-		Timeout: time.Second * 10,
+// EncodeText renders a GSL graph, e.g. the output of a GSL-format task,
+// into text in the given language.
+func (s *Shard) EncodeText(ctx context.Context, graph string, lang string) (string, error) {
+	graph = strings.TrimSpace(graph)
+	if graph == "" {
+		return "", ErrEmptyGraph
 	}
-
-	resp, err := netClient.Post(u.String(), "text/plain; charset=utf-8", bytes.NewBuffer([]byte(graph)))
-	if err != nil {
-		return "", err
+	if lang == "" {
+		lang = s.defaultLang()
 	}
-	defer resp.Body.Close()
+	return s.lingProc().Encode(ctx, graph, lang)
+}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	return string(body), nil
+// QueryTask wraps a GSL query of the repo into a task.
+func QueryTask(gsl string, lang string, format string) string {
+	var buf strings.Builder
+	// TODO graph expand depth option
+	buf.WriteString("{task{format " + format + "}")
+	buf.WriteString("{locale " + lang + "}")
+	buf.WriteString("{repo ~")
+	buf.WriteString(gsl)
+	buf.WriteString("}}")
+	return buf.String()
 }
 
 
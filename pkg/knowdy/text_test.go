@@ -1,6 +1,8 @@
 package knowdy
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -10,11 +12,11 @@ import (
 func TestDecodeTextTimeout(t *testing.T) {
 	shard := Shard{
 		shard:      nil,
-		KnowDBAddress: "localhost",
+		KnowdyAddress: "localhost",
 		LingProcAddress: "localhost",
 		workers:    nil,
 	}
-	_, err := shard.DecodeText("banana", "EN SyNode CS")
+	_, _, err := shard.DecodeText(context.Background(), "banana", "EN SyNode CS")
 	if err == nil {
 		t.Error(err)
 	}
@@ -28,12 +30,12 @@ func TestDecodeTextSuccess(t *testing.T) {
 
 	shard := Shard{
 		shard:      nil,
-		KnowDBAddress: "localhost",
+		KnowdyAddress: "localhost",
 		LingProcAddress: ts.URL[7:], // strip off http:// prefix
 		workers:    nil,
 	}
 
-	graph, err := shard.DecodeText("banana", "EN SyNode CS")
+	graph, _, err := shard.DecodeText(context.Background(), "banana", "EN SyNode CS")
 	if err != nil {
 		t.Error(err)
 	}
@@ -46,4 +48,41 @@ func TestDecodeTextSuccess(t *testing.T) {
 	}
 }
 
+func TestEncodeText(t *testing.T) {
+	shard := Shard{LingProc: NewFixtureLingProcFrom(LingFixture{
+		Encodes: []EncodeFixture{{Graph: "{class Banana}", Lang: "ru", Text: "банан"}},
+	})}
 
+	text, err := shard.EncodeText(context.Background(), " {class Banana}\n", "ru")
+	if err != nil || text != "банан" {
+		t.Errorf("got %q, %v", text, err)
+	}
+	if _, err := shard.EncodeText(context.Background(), "  ", "ru"); !errors.Is(err, ErrEmptyGraph) {
+		t.Errorf("expected ErrEmptyGraph, got %v", err)
+	}
+	if _, err := shard.EncodeText(context.Background(), "{class Apple}", "ru"); !errors.Is(err, ErrNoFixture) {
+		t.Errorf("expected ErrNoFixture, got %v", err)
+	}
+}
+
+func TestEncodeTextServiceError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unknown class", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	shard := Shard{LingProcAddress: ts.URL[7:]}
+	_, err := shard.EncodeText(context.Background(), "{class Banana}", "en")
+	var gerr *GlottieError
+	if !errors.As(err, &gerr) || gerr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a GlottieError with status 400, got %v", err)
+	}
+}
+
+func TestQueryTask(t *testing.T) {
+	got := QueryTask("{class Banana}", "ru", "GSL")
+	want := "{task{format GSL}{locale ru}{repo ~{class Banana}}}"
+	if got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
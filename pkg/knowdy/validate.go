@@ -0,0 +1,179 @@
+package knowdy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ValidationError points at a single problem in the script cache.
+type ValidationError struct {
+	Path string `json:"path"`
+	Msg  string `json:"msg"`
+}
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// ValidationErrors collects every problem found in one pass.
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs *ValidationErrors) add(path string, format string, args ...interface{}) {
+	*errs = append(*errs, ValidationError{path, fmt.Sprintf(format, args...)})
+}
+
+// ValidateScripts checks the scripts and the reactions referring to them:
+// every phase needs a body in the default language and every reaction
+// must point at an existing script.
+func ValidateScripts(scripts map[string]Script, langCaches []LangCache, defLang string) error {
+	var errs ValidationErrors
+
+	for key, script := range scripts {
+		path := "scripts." + key
+		if script.Id == "" {
+			errs.add(path+".id", "script id is missing")
+		} else if script.Id != key {
+			errs.add(path+".id", "script id %q does not match its key", script.Id)
+		}
+		if len(script.ScriptPhases) == 0 {
+			errs.add(path+".phases", "script has no phases")
+		}
+		for phaseId, phase := range script.ScriptPhases {
+			phasePath := path + ".phases." + phaseId
+			if phase.Body[defLang] == "" {
+				errs.add(phasePath+".body."+defLang, "phase has no body in the default language")
+			}
+			if len(phase.Resources) > MaxResources {
+				errs.add(phasePath+".resources", "%d resources exceed the limit of %d",
+					len(phase.Resources), MaxResources)
+			}
+			for i, opt := range phase.Menu {
+				if opt.Id == "" {
+					errs.add(fmt.Sprintf("%s.menu[%d].opt", phasePath, i), "menu option id is missing")
+				}
+			}
+		}
+	}
+
+	langs := make(map[string]bool)
+	for i, lc := range langCaches {
+		path := fmt.Sprintf("langcaches[%d]", i)
+		if lc.Id == "" {
+			errs.add(path+".id", "language id is missing")
+		} else if langs[lc.Id] {
+			errs.add(path+".id", "duplicate language %q", lc.Id)
+		}
+		langs[lc.Id] = true
+
+		for j, ctx := range lc.ScriptCtxs {
+			ctxPath := fmt.Sprintf("%s.ctxs[%d]", path, j)
+			if ctx.Id == "" {
+				errs.add(ctxPath+".id", "context id is missing")
+			}
+			for k, react := range ctx.ScriptReacts {
+				reactPath := fmt.Sprintf("%s.scripts[%d]", ctxPath, k)
+				if _, ok := scripts[react.Id]; !ok {
+					errs.add(reactPath+".id", "unknown script %q", react.Id)
+				}
+				if len(react.Triggers) == 0 {
+					errs.add(reactPath+".triggers", "reaction has no triggers")
+				}
+				for l, trig := range react.Triggers {
+					if NormalizeMsg(trig, lc.Id) == "" {
+						errs.add(fmt.Sprintf("%s.triggers[%d]", reactPath, l), "trigger is empty after normalization")
+					}
+				}
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+	return errs
+}
+
+// decodeJSON unmarshals data into v and reports the line, column and
+// field of the offending token instead of a bare byte offset.
+func decodeJSON(data []byte, v interface{}) error {
+	err := json.Unmarshal(data, v)
+	if err == nil {
+		return nil
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, col := offsetToPos(data, syntaxErr.Offset)
+		return fmt.Errorf("line %d, column %d: %v", line, col, syntaxErr)
+	case errors.As(err, &typeErr):
+		line, col := offsetToPos(data, typeErr.Offset)
+		return fmt.Errorf("line %d, column %d: %s: expected %v, got %s",
+			line, col, typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	return err
+}
+
+func offsetToPos(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	head := data[:offset]
+	line := bytes.Count(head, []byte("\n")) + 1
+	col := len(head) - bytes.LastIndexByte(head, '\n')
+	return line, col
+}
+
+// writeFileAtomic replaces a file so that readers never see a partial write.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := stageFile(filename, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, filename)
+}
+
+// stageFile writes data to a temporary file next to filename, ready to be
+// renamed over it. The caller removes the file if the rename never happens.
+func stageFile(filename string, data []byte) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
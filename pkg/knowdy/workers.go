@@ -0,0 +1,198 @@
+package knowdy
+
+//#include <knd_shard.h>
+//#include <knd_task.h>
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// MaxWorkers is the default of ShardOptions.MaxWorkers, which bounds
+	// the pool size a shard can grow to at runtime.
+	MaxWorkers = 256
+
+	ErrShardClosed   = errors.New("shard is closed")
+	ErrShardDraining = errors.New("shard is shutting down")
+
+	// live counts of engine objects, kept to catch leaks
+	liveShards int64
+	liveTasks  int64
+
+	// taskNewHook lets tests fail the creation of a task
+	taskNewHook func(id int) error
+)
+
+// PoolObserver is told how long requests wait for a worker and how long
+// tasks run, e.g. to export metrics.
+type PoolObserver interface {
+	WorkerWait(d time.Duration)
+	TaskDone(taskType string, phase string, d time.Duration)
+}
+
+type PoolStats struct {
+	Size int `json:"size"`
+	Busy int `json:"busy"`
+	Max  int `json:"max"`
+}
+
+func phaseToStr(v C.int) string {
+	switch v {
+	case C.KND_CONFIRM_COMMIT:
+		return "confirm-commit"
+	default:
+		return "init"
+	}
+}
+
+// newWorkers creates the first n workers; the channel leaves room for
+// growing the pool up to the shard's max workers.
+func (s *Shard) newWorkers(n int) error {
+	max := s.maxWorkers
+	if max <= 0 {
+		max = MaxWorkers
+	}
+	if n > max {
+		max = n
+	}
+	s.workers = make(chan *C.struct_kndTask, max)
+	return s.grow(n)
+}
+
+// grow is called with resizeMu held or before the shard is shared.
+func (s *Shard) grow(n int) error {
+	for i := 0; i < n; i++ {
+		var task *C.struct_kndTask
+		id := atomic.AddInt32(&s.nextTaskId, 1) - 1
+		if taskNewHook != nil {
+			if err := taskNewHook(int(id)); err != nil {
+				return fmt.Errorf("could not create kndTask %d: %w", id, err)
+			}
+		}
+		errCode := C.knd_task_new(s.shard, nil, C.int(id), &task)
+		if errCode != C.int(0) {
+			return fmt.Errorf("could not create kndTask %d", id)
+		}
+		atomic.AddInt64(&liveTasks, 1)
+		atomic.AddInt32(&s.poolSize, 1)
+		s.workers <- task
+	}
+	return nil
+}
+
+// acquire counts the task in flight before checking for a drain, so that
+// Drain either sees the task or the task sees the drain.
+func (s *Shard) acquire() (*C.struct_kndTask, error) {
+	atomic.AddInt32(&s.inflight, 1)
+	if atomic.LoadInt32(&s.draining) != 0 {
+		atomic.AddInt32(&s.inflight, -1)
+		return nil, ErrShardDraining
+	}
+	start := time.Now()
+	worker, ok := <-s.workers
+	if !ok {
+		atomic.AddInt32(&s.inflight, -1)
+		return nil, ErrShardClosed
+	}
+	atomic.AddInt32(&s.busy, 1)
+	if s.Observer != nil {
+		s.Observer.WorkerWait(time.Since(start))
+	}
+	return worker, nil
+}
+
+func (s *Shard) release(worker *C.struct_kndTask) {
+	atomic.AddInt32(&s.busy, -1)
+	s.workers <- worker
+	atomic.AddInt32(&s.inflight, -1)
+}
+
+func (s *Shard) observeTask(taskType string, phase string, start time.Time) {
+	if s.Observer != nil {
+		s.Observer.TaskDone(taskType, phase, time.Since(start))
+	}
+}
+
+// PoolStats reports the current size of the worker pool and how many
+// workers are running tasks.
+func (s *Shard) PoolStats() PoolStats {
+	return PoolStats{
+		Size: int(atomic.LoadInt32(&s.poolSize)),
+		Busy: int(atomic.LoadInt32(&s.busy)),
+		Max:  cap(s.workers),
+	}
+}
+
+// ResizePool grows or shrinks the worker pool. Shrinking waits for busy
+// workers to finish their tasks; when ctx is done first the pool is left
+// at the size reached so far.
+func (s *Shard) ResizePool(ctx context.Context, n int) error {
+	if n < 1 || n > cap(s.workers) {
+		return fmt.Errorf("pool size must be within [1, %d]", cap(s.workers))
+	}
+	s.resizeMu.Lock()
+	defer s.resizeMu.Unlock()
+	if s.closed {
+		return ErrShardClosed
+	}
+
+	size := int(atomic.LoadInt32(&s.poolSize))
+	if n > size {
+		return s.grow(n - size)
+	}
+	for ; size > n; size-- {
+		select {
+		case worker := <-s.workers:
+			s.delTask(worker)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *Shard) delTask(worker *C.struct_kndTask) {
+	C.knd_task_del(worker)
+	atomic.AddInt64(&liveTasks, -1)
+	atomic.AddInt32(&s.poolSize, -1)
+}
+
+// delWorkers waits for every worker to come back from its task, frees
+// them all and closes the pool; it is called with resizeMu held.
+func (s *Shard) delWorkers() {
+	if s.workers == nil {
+		return
+	}
+	for atomic.LoadInt32(&s.poolSize) > 0 {
+		s.delTask(<-s.workers)
+	}
+	close(s.workers)
+}
+
+// Drain stops taking new tasks, then waits for the running ones and for
+// the commit outbox to empty. When ctx is done first the error says what
+// was left; the shard must not be deleted while tasks are still running.
+func (s *Shard) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&s.inflight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d tasks still running: %w", atomic.LoadInt32(&s.inflight), ctx.Err())
+		}
+	}
+	if s.Outbox != nil {
+		if err := s.Outbox.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
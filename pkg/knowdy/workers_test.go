@@ -0,0 +1,181 @@
+package knowdy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingObserver struct {
+	mu    sync.Mutex
+	waits int
+	tasks map[string]int
+}
+
+func (o *countingObserver) WorkerWait(d time.Duration) {
+	o.mu.Lock()
+	o.waits++
+	o.mu.Unlock()
+}
+
+func (o *countingObserver) TaskDone(taskType string, phase string, d time.Duration) {
+	o.mu.Lock()
+	o.tasks[taskType+"/"+phase]++
+	o.mu.Unlock()
+}
+
+func newTestPoolShard(t *testing.T, workers int) *Shard {
+	scripts, msgs := writeTestCaches(t)
+	savedScripts, savedMsgs := DBCacheFilename, MsgCacheFilename
+	DBCacheFilename, MsgCacheFilename = scripts, msgs
+	t.Cleanup(func() { DBCacheFilename, MsgCacheFilename = savedScripts, savedMsgs })
+
+	shard, err := New(shardCfg, "localhost:8081", "knowdy", "localhost:8069", "localhost", []string{"public"}, workers, ShardOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shard.Del() })
+	return shard
+}
+
+func TestResizePool(t *testing.T) {
+	shard := newTestPoolShard(t, 2)
+	if stats := shard.PoolStats(); stats.Size != 2 || stats.Busy != 0 || stats.Max != MaxWorkers {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if err := shard.ResizePool(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+	if size := shard.PoolStats().Size; size != 5 {
+		t.Errorf("grown to %d, want 5", size)
+	}
+	if err := shard.ResizePool(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if size := shard.PoolStats().Size; size != 1 {
+		t.Errorf("shrunk to %d, want 1", size)
+	}
+	if _, _, err := shard.RunTask("{task}", len("{task}")); err != nil {
+		t.Error(err)
+	}
+	for _, n := range []int{0, MaxWorkers + 1} {
+		if err := shard.ResizePool(context.Background(), n); err == nil {
+			t.Errorf("size %d should be refused", n)
+		}
+	}
+}
+
+func TestResizePoolWaitsForBusyWorkers(t *testing.T) {
+	shard := newTestPoolShard(t, 3)
+	w1, err := shard.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := shard.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if busy := shard.PoolStats().Busy; busy != 2 {
+		t.Fatalf("busy %d, want 2", busy)
+	}
+
+	// the idle worker goes at once, the busy ones are waited for
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := shard.ResizePool(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if size := shard.PoolStats().Size; size != 2 {
+		t.Errorf("size %d, want 2", size)
+	}
+
+	shard.release(w1)
+	shard.release(w2)
+	if err := shard.ResizePool(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if stats := shard.PoolStats(); stats.Size != 1 || stats.Busy != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPoolObserver(t *testing.T) {
+	shard := newTestPoolShard(t, 1)
+	o := &countingObserver{tasks: make(map[string]int)}
+	shard.Observer = o
+
+	if _, _, err := shard.RunTask("{task}", len("{task}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, taskType, err := shard.RunTask("{select User}", len("{select User}")); err != nil || taskType != "select" {
+		t.Fatalf("got task type %q, %v", taskType, err)
+	}
+	if _, err := shard.BuildJSON("{class Banana}", "en"); err != nil {
+		t.Fatal(err)
+	}
+	if o.waits != 3 || o.tasks["get/init"] != 1 || o.tasks["select/init"] != 1 || o.tasks["build-json/init"] != 1 {
+		t.Errorf("unexpected observations %d %v", o.waits, o.tasks)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	shard := newTestPoolShard(t, 2)
+	worker, err := shard.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := shard.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout with a task running, got %v", err)
+	}
+	if _, _, err := shard.RunTask("{task}", len("{task}")); !errors.Is(err, ErrShardDraining) {
+		t.Errorf("new tasks should be refused, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		shard.release(worker)
+	}()
+	if err := shard.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := shard.Del(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDrainWaitsForQueuedTasks(t *testing.T) {
+	shard := newTestPoolShard(t, 1)
+	worker, err := shard.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a task that passed the drain check before any worker was free
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := shard.RunTask("{task}", len("{task}"))
+		done <- err
+	}()
+	for atomic.LoadInt32(&shard.inflight) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- shard.Drain(context.Background()) }()
+	shard.release(worker)
+	if err := <-done; err != nil {
+		t.Fatalf("queued task failed: %v", err)
+	}
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&shard.inflight); n != 0 {
+		t.Errorf("%d tasks in flight after drain", n)
+	}
+}
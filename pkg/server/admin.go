@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/globbie/aide/pkg/knowdy"
+	"github.com/globbie/aide/pkg/session"
+)
+
+const adminRole = "admin"
+
+func adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ses, ok := r.Context().Value("session").(*session.ChatSession)
+		if !ok || !ses.HasRole(adminRole) {
+			http.Error(w, "{\"error\":\"forbidden\"}", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) registerAdminRoutes(router *mux.Router) {
+	shard := s.shard
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.authorization, adminOnly)
+	admin.Handle("/scripts", scriptsHandler(shard)).Methods(http.MethodGet, http.MethodPost)
+	admin.Handle("/scripts/{id}", scriptHandler(shard)).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	admin.Handle("/reactions/{lang}/{ctx}", reactionsHandler(shard)).Methods(http.MethodGet, http.MethodPost)
+	admin.Handle("/reactions/{lang}/{ctx}/{id}", reactionHandler(shard)).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	admin.Handle("/shards", shardsHandler(shard)).Methods(http.MethodGet)
+	admin.Handle("/commits", commitsHandler(shard)).Methods(http.MethodGet)
+	admin.Handle("/workers", workersHandler(shard)).Methods(http.MethodGet, http.MethodPut)
+	admin.Handle("/config", s.configHandler()).Methods(http.MethodGet)
+	admin.Handle("/config/reload", s.configReloadHandler()).Methods(http.MethodPost)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeAdminError maps cache edit errors onto HTTP statuses; validation
+// problems are listed with their paths.
+func writeAdminError(w http.ResponseWriter, err error) {
+	var problems knowdy.ValidationErrors
+	switch {
+	case errors.Is(err, knowdy.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, knowdy.ErrExists):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.As(err, &problems):
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":    "validation failed",
+			"problems": problems,
+		})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+func scriptsHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, shard.Cache().Scripts)
+			return
+		}
+		var script knowdy.Script
+		if !decodeBody(w, r, &script) {
+			return
+		}
+		if err := shard.PutScript(script, true); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, script)
+	})
+}
+
+func scriptHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		switch r.Method {
+		case http.MethodGet:
+			script, err := shard.GetScript(id)
+			if err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, script)
+		case http.MethodPut:
+			var script knowdy.Script
+			if !decodeBody(w, r, &script) {
+				return
+			}
+			if script.Id == "" {
+				script.Id = id
+			}
+			if script.Id != id {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "script id does not match the URL"})
+				return
+			}
+			if err := shard.PutScript(script, false); err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, script)
+		case http.MethodDelete:
+			if err := shard.DeleteScript(id); err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
+
+func reactionsHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if r.Method == http.MethodGet {
+			reacts, err := shard.GetReactions(vars["lang"], vars["ctx"])
+			if err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, reacts)
+			return
+		}
+		var react knowdy.ScriptReact
+		if !decodeBody(w, r, &react) {
+			return
+		}
+		if err := shard.PutReaction(vars["lang"], vars["ctx"], react, true); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, react)
+	})
+}
+
+func reactionHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		switch r.Method {
+		case http.MethodGet:
+			react, err := shard.GetReaction(vars["lang"], vars["ctx"], vars["id"])
+			if err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, react)
+		case http.MethodPut:
+			var react knowdy.ScriptReact
+			if !decodeBody(w, r, &react) {
+				return
+			}
+			if react.Id == "" {
+				react.Id = vars["id"]
+			}
+			if react.Id != vars["id"] {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "reaction id does not match the URL"})
+				return
+			}
+			if err := shard.PutReaction(vars["lang"], vars["ctx"], react, false); err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, react)
+		case http.MethodDelete:
+			if err := shard.DeleteReaction(vars["lang"], vars["ctx"], vars["id"]); err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
+
+// commitsHandler lists the commits still waiting for the authority.
+func commitsHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shard.Outbox == nil {
+			writeJSON(w, http.StatusOK, []knowdy.PendingCommit{})
+			return
+		}
+		writeJSON(w, http.StatusOK, shard.Outbox.Pending())
+	})
+}
+
+// workersHandler shows the worker pool and resizes it on PUT {"size": n}.
+func workersHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var req struct {
+				Size int `json:"size"`
+			}
+			if !decodeBody(w, r, &req) {
+				return
+			}
+			if err := shard.ResizePool(r.Context(), req.Size); err != nil {
+				writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, shard.PoolStats())
+	})
+}
@@ -0,0 +1,496 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+
+	"github.com/globbie/aide/pkg/knowdy"
+	"github.com/globbie/aide/pkg/session"
+)
+
+// Config is read from aide.json; every key can be overridden with an
+// AIDE_* environment variable.
+type Config struct {
+	ListenAddress     string               `json:"listen-address"`
+	ServiceDomain     string               `json:"service-domain"`
+	KnowdyAddress     string               `json:"knowdy-address"`
+	KnowdyServiceName string               `json:"knowdy-service-name"`
+	KnowdyShards      []string             `json:"knowdy-shards" config:"reload"`
+	ShardName         string               `json:"shard-name"`
+	PlacementShards   []string             `json:"placement-shards"`
+	ShardPollInterval time.Duration        `json:"shard-poll-interval"`
+	LingProcAddress   string               `json:"ling-service-name"`
+	KndConfigPath     string               `json:"shard-config"`
+	CommitOutboxPath  string               `json:"commit-outbox-path"`
+	MailServerAddress string               `json:"mail-server-address"`
+	MailServerUser    string               `json:"mail-server-user"`
+	MailServerAuth    string               `json:"mail-server-auth" config:"secret"`
+	RequestsMax       int                  `json:"requests-max" config:"reload"`
+	Workers           int                  `json:"workers"`
+	MaxWorkers        int                  `json:"max-workers"`
+	SlotAwaitDuration time.Duration        `json:"slot-await-duration" config:"reload"`
+	RateLimits        map[string]RateLimit `json:"rate-limits" config:"reload"`
+	TrustedProxies    []string             `json:"trusted-proxies"`
+	ShutdownTimeout   time.Duration        `json:"shutdown-timeout" config:"reload"`
+	SignKeyPath       string               `json:"sign-key-path"`
+	StaticPath        string               `json:"static-path" config:"reload"`
+	VerifyKeyPath     string               `json:"verify-key-path"`
+	DefaultLang       string               `json:"default-lang"`
+	DecodeCacheSize   int                  `json:"decode-cache-size"`
+	DecodeCacheTTL    time.Duration        `json:"decode-cache-ttl"`
+	ResourcePath      string               `json:"resource-path"`
+	LingProc          string               `json:"ling-proc"`
+	LingSchemaPath    string               `json:"ling-schema-path"`
+	LingFixturePath   string               `json:"ling-fixture-path"`
+}
+
+// Sources tells where each config value, by its JSON key, comes from.
+type Sources map[string]string
+
+// where a config value comes from
+const (
+	SourceDefault    = "default"
+	SourceFile       = "file"
+	SourceSecretFile = "secret file"
+	SourceEnv        = "env"
+	SourceFlag       = "flag"
+)
+
+const (
+	redacted = "[redacted]"
+	// envPrefix starts the environment variable of every config key:
+	// listen-address is AIDE_LISTEN_ADDRESS.
+	envPrefix = "AIDE_"
+	// secretFileSuffix names a file holding a secret value, e.g.
+	// mail-server-auth-file or AIDE_MAIL_SERVER_AUTH_FILE.
+	secretFileSuffix = "-file"
+)
+
+// Override changes a loaded config before it is validated, e.g. with
+// command line parameters.
+type Override func(c *Config, sources Sources)
+
+var errNoReload = errors.New("config reload is not configured")
+
+// configField describes a Config field by its JSON key. Fields tagged
+// config:"reload" are reread on reload, config:"secret" ones are never
+// shown.
+type configField struct {
+	key    string
+	index  int
+	reload bool
+	secret bool
+}
+
+func configFields() []configField {
+	var fields []configField
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		opts := f.Tag.Get("config")
+		fields = append(fields, configField{
+			key:    key,
+			index:  i,
+			reload: opts == "reload",
+			secret: opts == "secret",
+		})
+	}
+	return fields
+}
+
+// ConfigError points at a problem with a config value.
+type ConfigError struct {
+	Key string `json:"key"`
+	Msg string `json:"msg"`
+}
+
+func (e ConfigError) Error() string {
+	return e.Key + ": " + e.Msg
+}
+
+// ConfigErrors collects every problem found while loading the config.
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs *ConfigErrors) add(key string, format string, args ...interface{}) {
+	*errs = append(*errs, ConfigError{key, fmt.Sprintf(format, args...)})
+}
+
+// defaultConfig holds the values of the keys missing from the file.
+func defaultConfig() Config {
+	return Config{
+		KndConfigPath:     "/etc/aide/shard.gsl",
+		RequestsMax:       10,
+		SlotAwaitDuration: time.Second,
+	}
+}
+
+// LoadConfig reads the config file, overrides it with the environment
+// and then with the overrides, noting the source of every value. The
+// result is validated; all problems are returned at once as ConfigErrors.
+func LoadConfig(path string, overrides ...Override) (*Config, Sources, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read AIDE config, error: %w", err)
+	}
+	c := defaultConfig()
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, nil, fmt.Errorf("could not unmarshal config file, error: %w", err)
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, nil, fmt.Errorf("could not unmarshal config file, error: %w", err)
+	}
+
+	var errs ConfigErrors
+	sources := make(Sources)
+	v := reflect.ValueOf(&c).Elem()
+	for _, f := range configFields() {
+		sources[f.key] = SourceDefault
+		if _, ok := keys[f.key]; ok {
+			sources[f.key] = SourceFile
+		}
+		if raw, ok := keys[f.key+secretFileSuffix]; ok && f.secret {
+			var secretPath string
+			if err := json.Unmarshal(raw, &secretPath); err != nil {
+				errs.add(f.key+secretFileSuffix, "must be a path")
+			} else if readSecret(v.Field(f.index), f.key, secretPath, &errs) {
+				sources[f.key] = SourceSecretFile
+			}
+		}
+	}
+	applyEnv(&c, sources, &errs)
+	for _, override := range overrides {
+		override(&c, sources)
+	}
+	c.validate(&errs)
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return &c, sources, nil
+}
+
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+func readSecret(field reflect.Value, key string, path string, errs *ConfigErrors) bool {
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		errs.add(key+secretFileSuffix, "could not read the secret: %v", err)
+		return false
+	}
+	field.SetString(strings.TrimRight(string(secret), "\r\n"))
+	return true
+}
+
+// applyEnv overrides the config with AIDE_* variables. Lists are comma
+// separated, durations are written like 1m30s and maps in JSON.
+func applyEnv(c *Config, sources Sources, errs *ConfigErrors) {
+	v := reflect.ValueOf(c).Elem()
+	for _, f := range configFields() {
+		if f.secret {
+			name := envName(f.key + secretFileSuffix)
+			if path, ok := os.LookupEnv(name); ok {
+				if readSecret(v.Field(f.index), f.key, path, errs) {
+					sources[f.key] = SourceSecretFile
+				}
+			}
+		}
+		name := envName(f.key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(f.index), value); err != nil {
+			errs.add(f.key, "invalid %s: %v", name, err)
+			continue
+		}
+		sources[f.key] = SourceEnv
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Map:
+		m := reflect.New(field.Type())
+		if err := json.Unmarshal([]byte(value), m.Interface()); err != nil {
+			return err
+		}
+		field.Set(m.Elem())
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validate reports the values aide cannot start with.
+func (c *Config) validate(errs *ConfigErrors) {
+	if c.ListenAddress == "" {
+		errs.add("listen-address", "is empty")
+	} else if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		errs.add("listen-address", "%v", err)
+	}
+	if c.KnowdyAddress != "" {
+		if _, _, err := net.SplitHostPort(c.KnowdyAddress); err != nil {
+			errs.add("knowdy-address", "%v", err)
+		}
+	}
+	if c.KnowdyServiceName == "" {
+		errs.add("knowdy-service-name", "is empty")
+	}
+	if len(c.KnowdyShards) == 0 {
+		errs.add("knowdy-shards", "no shards are configured")
+	}
+	if c.ShardName != "" && !contains(c.KnowdyShards, c.ShardName) {
+		errs.add("shard-name", "%q is not one of knowdy-shards", c.ShardName)
+	}
+	for _, name := range c.PlacementShards {
+		if !contains(c.KnowdyShards, name) {
+			errs.add("placement-shards", "%q is not one of knowdy-shards", name)
+		}
+	}
+
+	requireFile := func(key string, path string) {
+		if path == "" {
+			errs.add(key, "is empty")
+		} else if _, err := os.Stat(path); err != nil {
+			errs.add(key, "%v", err)
+		}
+	}
+	requireFile("shard-config", c.KndConfigPath)
+	requireFile("sign-key-path", c.SignKeyPath)
+	requireFile("verify-key-path", c.VerifyKeyPath)
+
+	switch c.LingProc {
+	case "", "glottie":
+		if c.LingProcAddress == "" {
+			errs.add("ling-service-name", "is empty")
+		}
+	case "local":
+		requireFile("ling-schema-path", c.LingSchemaPath)
+	case "fixture":
+		requireFile("ling-fixture-path", c.LingFixturePath)
+	default:
+		errs.add("ling-proc", "unknown ling processor %q", c.LingProc)
+	}
+
+	if c.RequestsMax < 1 {
+		errs.add("requests-max", "must be at least 1")
+	}
+	if c.Workers < 0 {
+		errs.add("workers", "must not be negative")
+	}
+	if c.MaxWorkers < 0 {
+		errs.add("max-workers", "must not be negative")
+	} else if c.MaxWorkers > 0 && c.Workers > c.MaxWorkers {
+		errs.add("workers", "exceeds max-workers %d", c.MaxWorkers)
+	}
+	if c.DecodeCacheSize < 0 {
+		errs.add("decode-cache-size", "must not be negative")
+	}
+	durations := []struct {
+		key string
+		d   time.Duration
+	}{
+		{"shard-poll-interval", c.ShardPollInterval},
+		{"slot-await-duration", c.SlotAwaitDuration},
+		{"shutdown-timeout", c.ShutdownTimeout},
+		{"decode-cache-ttl", c.DecodeCacheTTL},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			errs.add(d.key, "must not be negative")
+		}
+	}
+	routes := make([]string, 0, len(c.RateLimits))
+	for route := range c.RateLimits {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		limit := c.RateLimits[route]
+		key := "rate-limits." + route
+		if !contains(rateLimitedRoutes, route) {
+			errs.add(key, "unknown route, expected one of %s", strings.Join(rateLimitedRoutes, ", "))
+		}
+		if limit.Rate <= 0 {
+			errs.add(key+".rate", "must be positive")
+		}
+		if limit.Burst < 1 {
+			errs.add(key+".burst", "must be at least 1")
+		}
+	}
+	for _, cidr := range c.TrustedProxies {
+		if _, err := session.ParseProxy(cidr); err != nil {
+			errs.add("trusted-proxies", "%v", err)
+		}
+	}
+	if c.DefaultLang != "" {
+		if _, err := language.Parse(c.DefaultLang); err != nil {
+			errs.add("default-lang", "%v", err)
+		}
+	}
+	if c.MailServerAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MailServerAddress); err != nil {
+			errs.add("mail-server-address", "%v", err)
+		}
+	}
+}
+
+type configValue struct {
+	Value      interface{} `json:"value"`
+	Source     string      `json:"source"`
+	Reloadable bool        `json:"reloadable"`
+}
+
+// describeConfig lists every value of c with its source, secrets redacted.
+func describeConfig(c *Config, sources Sources) map[string]configValue {
+	v := reflect.ValueOf(c).Elem()
+	values := make(map[string]configValue)
+	for _, f := range configFields() {
+		value := v.Field(f.index).Interface()
+		if f.secret && !v.Field(f.index).IsZero() {
+			value = redacted
+		}
+		values[f.key] = configValue{
+			Value:      value,
+			Source:     sources[f.key],
+			Reloadable: f.reload,
+		}
+	}
+	return values
+}
+
+type configReload struct {
+	Reloaded        []string `json:"reloaded"`
+	RestartRequired []string `json:"restart-required"`
+}
+
+// reloadConfig reads the config again and puts the reloadable values
+// into effect. Other changed values are only reported: they take effect
+// on restart.
+func (s *Server) reloadConfig() (configReload, error) {
+	var result configReload
+	if s.reload == nil {
+		return result, errNoReload
+	}
+	loaded, loadedSources, err := s.reload()
+	if err != nil {
+		return result, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := *s.cfg
+	sources := make(Sources, len(s.sources))
+	for k, v := range s.sources {
+		sources[k] = v
+	}
+	prev := reflect.ValueOf(s.cfg).Elem()
+	nextV := reflect.ValueOf(&next).Elem()
+	loadedV := reflect.ValueOf(loaded).Elem()
+	for _, f := range configFields() {
+		if reflect.DeepEqual(prev.Field(f.index).Interface(), loadedV.Field(f.index).Interface()) {
+			continue
+		}
+		if !f.reload {
+			result.RestartRequired = append(result.RestartRequired, f.key)
+			continue
+		}
+		nextV.Field(f.index).Set(loadedV.Field(f.index))
+		sources[f.key] = loadedSources[f.key]
+		result.Reloaded = append(result.Reloaded, f.key)
+	}
+
+	if !reflect.DeepEqual(s.cfg.KnowdyShards, next.KnowdyShards) {
+		s.shard.PeerShards.SetPeers(knowdy.PeerShardInfo(next.KnowdyServiceName, next.KnowdyAddress, next.KnowdyShards))
+	}
+	s.cfg, s.sources = &next, sources
+	return result, nil
+}
+
+func (s *Server) configHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		values := describeConfig(s.cfg, s.sources)
+		s.mu.RUnlock()
+		writeJSON(w, http.StatusOK, values)
+	})
+}
+
+func (s *Server) configReloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, err := s.reloadConfig()
+		var problems ConfigErrors
+		switch {
+		case errors.As(err, &problems):
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+				"error":    "invalid config",
+				"problems": problems,
+			})
+		case errors.Is(err, errNoReload):
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, result)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/text/language"
+
+	"github.com/globbie/aide/pkg/knowdy"
+)
+
+const (
+	geoMaxRadiusKm = 50.0
+	geoMaxLimit    = 100
+)
+
+func parseFloatParam(r *http.Request, name string, def float64) (float64, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// geoNearbyHandler lists the geotags around lat/lng with localized titles.
+func geoNearbyHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		q := r.URL.Query()
+		if q.Get("lat") == "" || q.Get("lng") == "" {
+			http.Error(w, "{\"error\":\"URL params lat and lng are required\"}", http.StatusBadRequest)
+			return
+		}
+		lat, okLat := parseFloatParam(r, "lat", 0)
+		lng, okLng := parseFloatParam(r, "lng", 0)
+		if !okLat || !okLng || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+			http.Error(w, "{\"error\":\"invalid lat or lng\"}", http.StatusBadRequest)
+			return
+		}
+		radius, ok := parseFloatParam(r, "radius", 1)
+		if !ok || radius <= 0 || radius > geoMaxRadiusKm {
+			http.Error(w, "{\"error\":\"radius must be within (0, 50] km\"}", http.StatusBadRequest)
+			return
+		}
+		limit := 10
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > geoMaxLimit {
+				http.Error(w, "{\"error\":\"limit must be within [1, 100]\"}", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		langs, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+		hits := shard.NearbyGeoTags(lat, lng, radius, limit, langs)
+		if hits == nil {
+			hits = []knowdy.GeoHit{}
+		}
+		_ = json.NewEncoder(w).Encode(hits)
+	})
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGeoNearbyParams(t *testing.T) {
+	ts := newTestServer(t, newTestConfig(), Deps{})
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"lat=55.75&lng=37.61", http.StatusOK},
+		{"lat=NaN&lng=37.61", http.StatusBadRequest},
+		{"lat=55.75&lng=Inf", http.StatusBadRequest},
+		{"lat=55.75&lng=37.61&radius=NaN", http.StatusBadRequest},
+		{"lat=55.75&lng=37.61&radius=-Inf", http.StatusBadRequest},
+		{"lat=91&lng=37.61", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if status, body := do(t, http.MethodGet, ts.URL+"/geo/nearby?"+tt.query, "", ""); status != tt.want {
+			t.Errorf("%s: got %d %s", tt.query, status, body)
+		}
+	}
+}
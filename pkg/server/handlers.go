@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/dgrijalva/jwt-go/request"
+	"github.com/gorilla/schema"
+	"golang.org/x/text/language"
+
+	"github.com/globbie/aide/pkg/knowdy"
+	"github.com/globbie/aide/pkg/session"
+)
+
+func logger(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Println(r.Method, r.URL.Path, r.URL.Query(), r.RemoteAddr, r.UserAgent())
+		h.ServeHTTP(w, r)
+	})
+}
+
+// limiter bounds the requests served at once to requests-max of the
+// current config. When the limit is reloaded requests already running
+// give their slot back to the previous semaphore.
+func (s *Server) limiter(h http.Handler) http.Handler {
+	var (
+		mu        sync.Mutex
+		semaphore chan struct{}
+	)
+	acquire := func(requestsMax int) chan struct{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if semaphore == nil || cap(semaphore) != requestsMax {
+			semaphore = make(chan struct{}, requestsMax)
+		}
+		return semaphore
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := s.Config()
+		sem := acquire(c.RequestsMax)
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			h.ServeHTTP(w, r)
+		case <-time.After(c.SlotAwaitDuration):
+			http.Error(w, "server is busy", http.StatusTooManyRequests)
+			log.Println("no free slots")
+			return
+		}
+	})
+}
+
+func (s *Server) parseSession(r *http.Request) (*session.ChatSession, error) {
+	token, err := request.ParseFromRequest(r, request.AuthorizationHeaderExtractor, func(token *jwt.Token) (interface{}, error) {
+		return s.verifyKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	ses, _ := session.New(r, s.proxies)
+
+	log.Printf("== UserId: %s, ShardId: %s Token expires: %s  Langs:%s",
+		claims["uid"], claims["shard"],
+		time.Unix(int64(claims["exp"].(float64)), 0), ses.Langs)
+
+	ses.UserId = claims["uid"].(string)
+	ses.ShardId = claims["shard"].(string)
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			if r, ok := role.(string); ok {
+				ses.Roles = append(ses.Roles, r)
+			}
+		}
+	}
+	return ses, nil
+}
+
+func (s *Server) authorization(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ses, err := s.parseSession(r)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "unauthorized "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "session", ses)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// optionalAuthorization lets anonymous requests through but still
+// rejects invalid tokens.
+func (s *Server) optionalAuthorization(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s.authorization(h).ServeHTTP(w, r)
+	})
+}
+
+func gslHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		defer r.Body.Close()
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), commitWait)
+		defer cancel()
+		result, taskType, err := shard.RunTaskContext(ctx, string(body), len(body))
+		if taskType == "commit" && (err == nil || errors.Is(err, knowdy.ErrCommitPending)) {
+			// reads of this client go to the authority for a while
+			session.SetLastCommit(w, time.Now(), shard.ServiceDomain, knowdy.ReadYourWritesWindow)
+		}
+		var rejected *knowdy.CommitRejectedError
+		switch {
+		case errors.Is(err, knowdy.ErrCommitPending):
+			// the commit is safe in the outbox and will be forwarded later
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, result)
+			return
+		case errors.As(err, &rejected):
+			http.Error(w, rejected.Body, http.StatusUnprocessableEntity)
+			return
+		case err != nil:
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		// TODO output formats
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, result)
+		if metrics, ok := r.Context().Value(metricsKey).(*Metrics); ok {
+			metrics.Success = true
+			metrics.TaskType = taskType
+		}
+	})
+}
+
+func msgHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "{\"error\":\""+err.Error()+"\"}", http.StatusBadRequest)
+			return
+		}
+		msg := new(knowdy.Message)
+		if err := schema.NewDecoder().Decode(msg, r.Form); err != nil {
+			http.Error(w, "URL error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ses, ok := r.Context().Value("session").(*session.ChatSession); ok {
+			msg.ChatSession = ses
+		}
+		if msg.Lat != nil && msg.Lng != nil && msg.ChatSession != nil {
+			msg.ChatSession.Location = &session.Location{Lat: *msg.Lat, Lng: *msg.Lng}
+		}
+		result, err := shard.ProcessMsg(r.Context(), msg)
+		if err != nil {
+			http.Error(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, result)
+
+		//if metrics, ok := r.Context().Value(metricsKey).(*Metrics); ok {
+		//	metrics.Success = true
+		//	metrics.TaskType = taskType
+		//}
+	})
+}
+
+func queryHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		gsl, ok := r.URL.Query()["gsl"]
+		if !ok || len(gsl) < 1 {
+			http.Error(w, "{\"error\":\"URL param gsl is missing\"}", http.StatusBadRequest)
+			return
+		}
+		lang := "en"
+		var Langs []language.Tag
+		Langs, _, _ = language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+		if len(Langs) > 0 {
+			lang = Langs[0].String()
+			i := strings.Index(lang, "-")
+			if i != -1 {
+				lang = lang[:i]
+			}
+		}
+		if r.URL.Query().Get("format") == "text" {
+			queryTextReply(w, r, shard, gsl[0], lang)
+			return
+		}
+		task := knowdy.QueryTask(gsl[0], lang, "JSON")
+
+		ses, _ := r.Context().Value("session").(*session.ChatSession)
+		result, err := shard.ReadTask(r.Context(), ses, task)
+		if err != nil {
+			log.Println(result)
+			// TODO set error status
+			http.Error(w, "{\"error\":\""+result+"\"}", http.StatusBadRequest)
+			return
+		}
+		// /geo/nearby is public: geotags of a signed-in user's reads stay private
+		if ses == nil {
+			shard.IndexGeoTags(knowdy.ExtractGeoTags(result, shard.DefaultLang))
+		}
+		_, _ = io.WriteString(w, result)
+	})
+}
+
+func (s *Server) sessionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		{ // check SID cookie
+			cookie, err := r.Cookie("sid")
+			if err == nil {
+				log.Println(">> sid cookie already set: " + cookie.Value)
+				claims := jwt.MapClaims{}
+				_, e := jwt.ParseWithClaims(cookie.Value, &claims, func(token *jwt.Token) (interface{}, error) {
+					return s.verifyKey, nil
+				})
+				if e != nil {
+					http.Error(w, "invalid SID", http.StatusBadRequest)
+					return
+				}
+				for key, val := range claims {
+					fmt.Printf("Key: %v, value: %v\n", key, val)
+				}
+				_, _ = io.WriteString(w, "{\"sid\":\""+cookie.Value+"\"}")
+				return
+			}
+		}
+		ses, _ := session.New(r, s.proxies)
+		result, cookies, err := s.shard.CreateChatSession(ses, s.signKey)
+		if errors.Is(err, knowdy.ErrNoCapacity) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.shard.PeerShards.PollInterval.Seconds())))
+			http.Error(w, "{\"error\":\"no shard has capacity for a new session\"}", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to open a session: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, cookie := range cookies {
+			http.SetCookie(w, cookie)
+		}
+		_, _ = io.WriteString(w, result)
+	})
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/globbie/aide/pkg/knowdy"
+)
+
+// healthzHandler only tells that the process serves HTTP.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+// readyzHandler reports every dependency; traffic should only be routed
+// here while all of them are fine.
+func readyzHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readiness := shard.CheckReadiness(r.Context())
+		status := http.StatusOK
+		if !readiness.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, readiness)
+	})
+}
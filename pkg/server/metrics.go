@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/globbie/aide/pkg/knowdy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsKey = "metrics"
+
+// serverMetrics are the request counters of a server.
+type serverMetrics struct {
+	failuresTotal  prometheus.Counter
+	successesTotal *prometheus.CounterVec
+	requestsActive prometheus.Gauge
+
+	rateLimitDecisions *prometheus.CounterVec
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		failuresTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "aide_requests_failed_total",
+				Help: "Total number of failures.",
+			}),
+		successesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "aide_requests_completed_total",
+				Help: "Total number of completed requests.",
+			},
+			[]string{
+				"type", // create | update | remove | get
+			}),
+		requestsActive: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "aide_requests_active",
+				Help: "Number of active requests.",
+			}),
+		rateLimitDecisions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "aide_rate_limit_decisions_total",
+				Help: "Total number of rate limiter decisions.",
+			},
+			[]string{
+				"route",
+				"decision", // allowed | limited
+			}),
+	}
+}
+
+func (m *serverMetrics) register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{m.failuresTotal, m.successesTotal, m.requestsActive, m.rateLimitDecisions} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	// Flush metrics to Prometheus.
+	m.failuresTotal.Add(0)
+	for _, s := range []string{"create", "update", "remove", "get"} {
+		m.successesTotal.WithLabelValues(s).Add(0)
+	}
+	m.requestsActive.Add(0)
+	return nil
+}
+
+func registerDecodeCacheMetrics(reg prometheus.Registerer, c *knowdy.DecodeCache) error {
+	collectors := []prometheus.Collector{
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "aide_decode_cache_hits_total",
+				Help: "Total number of decode cache hits.",
+			}, func() float64 { return float64(c.Stats().Hits) }),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "aide_decode_cache_misses_total",
+				Help: "Total number of decode cache misses.",
+			}, func() float64 { return float64(c.Stats().Misses) }),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "aide_decode_cache_evictions_total",
+				Help: "Total number of decode cache entries evicted by size.",
+			}, func() float64 { return float64(c.Stats().Evictions) }),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "aide_decode_cache_entries",
+				Help: "Number of entries in the decode cache.",
+			}, func() float64 { return float64(c.Stats().Size) }),
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// poolObserver exports the worker pool timings of a shard.
+type poolObserver struct {
+	wait     prometheus.Histogram
+	duration *prometheus.HistogramVec
+}
+
+func (o *poolObserver) WorkerWait(d time.Duration) {
+	o.wait.Observe(d.Seconds())
+}
+
+func (o *poolObserver) TaskDone(taskType string, phase string, d time.Duration) {
+	o.duration.WithLabelValues(taskType, phase).Observe(d.Seconds())
+}
+
+func registerPoolMetrics(reg prometheus.Registerer, shard *knowdy.Shard) (knowdy.PoolObserver, error) {
+	o := poolObserver{
+		wait: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "aide_worker_acquire_wait_seconds",
+				Help:    "Time spent waiting for a free knowdy worker.",
+				Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+			}),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "aide_task_duration_seconds",
+				Help:    "Knowdy task execution time.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{
+				"type",  // get | commit | build-json | error
+				"phase", // init | confirm-commit
+			}),
+	}
+	collectors := []prometheus.Collector{
+		o.wait,
+		o.duration,
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "aide_workers_busy",
+				Help: "Number of knowdy workers running tasks.",
+			}, func() float64 { return float64(shard.PoolStats().Busy) }),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "aide_workers",
+				Help: "Size of the knowdy worker pool.",
+			}, func() float64 { return float64(shard.PoolStats().Size) }),
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return &o, nil
+}
+
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
+type Metrics struct {
+	Success  bool
+	TaskType string
+}
+
+func (s *Server) measurer(h http.Handler) http.Handler {
+	m := s.metrics
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.requestsActive.Inc()
+		defer m.requestsActive.Dec()
+
+		var metrics Metrics
+		ctx := context.WithValue(r.Context(), metricsKey, &metrics)
+		h.ServeHTTP(w, r.WithContext(ctx))
+
+		if metrics.Success {
+			m.successesTotal.WithLabelValues(metrics.TaskType).Inc()
+		} else {
+			m.failuresTotal.Inc()
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/globbie/aide/pkg/session"
+)
+
+// RateLimit is a token bucket: Rate requests per second on average with
+// bursts of up to Burst requests.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// defaultRateLimit is the rate-limits entry of routes without their own.
+const defaultRateLimit = "default"
+
+// rateLimitedRoutes may be named in rate-limits.
+var rateLimitedRoutes = []string{defaultRateLimit, "/session", "/query", "/gsl", "/msg", "/text/encode", "/geo/nearby"}
+
+// buckets are swept once a limiter keeps this many
+const maxBuckets = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per user or client.
+type rateLimiter struct {
+	limit RateLimit
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+type rateDecision struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration // until the next token
+	reset      time.Duration // until the bucket is full again
+}
+
+// take spends a token of the key's bucket if there is one.
+func (l *rateLimiter) take(key string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	burst := float64(l.limit.Burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+		b.last = now
+	}
+
+	var d rateDecision
+	if b.tokens >= 1 {
+		b.tokens--
+		d.allowed = true
+	} else {
+		d.retryAfter = l.refill(1 - b.tokens)
+	}
+	d.remaining = int(b.tokens)
+	d.reset = l.refill(burst - b.tokens)
+	return d
+}
+
+func (l *rateLimiter) refill(tokens float64) time.Duration {
+	return time.Duration(tokens / l.limit.Rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled: they are no different
+// from new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey is the uid of an authorized request, otherwise the
+// client IP.
+func (s *Server) rateLimitKey(r *http.Request) string {
+	if ses, ok := r.Context().Value("session").(*session.ChatSession); ok && ses.UserId != "" {
+		return "uid:" + ses.UserId
+	}
+	ip, err := session.GetSessionIP(r, s.proxies)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// seconds rounds d up to whole seconds, as headers want them.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// rateLimit applies the rate-limits entry of the route, or the default
+// one, to every user; it goes after authorization. Routes without a
+// limit are not limited.
+func (s *Server) rateLimit(route string, h http.Handler) http.Handler {
+	var (
+		mu      sync.Mutex
+		limiter *rateLimiter
+	)
+	current := func() *rateLimiter {
+		limits := s.Config().RateLimits
+		limit, ok := limits[route]
+		if !ok {
+			limit, ok = limits[defaultRateLimit]
+		}
+		if !ok {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// a reloaded limit starts with full buckets
+		if limiter == nil || limiter.limit != limit {
+			limiter = newRateLimiter(limit)
+		}
+		return limiter
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := current()
+		if l == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		d := l.take(s.rateLimitKey(r))
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.limit.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(d.remaining))
+		w.Header().Set("X-RateLimit-Reset", seconds(d.reset))
+		if !d.allowed {
+			s.metrics.rateLimitDecisions.WithLabelValues(route, "limited").Inc()
+			w.Header().Set("Retry-After", seconds(d.retryAfter))
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limit exceeded"})
+			return
+		}
+		s.metrics.rateLimitDecisions.WithLabelValues(route, "allowed").Inc()
+		h.ServeHTTP(w, r)
+	})
+}
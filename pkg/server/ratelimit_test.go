@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(RateLimit{Rate: 2, Burst: 3})
+	l.now = func() time.Time { return now }
+
+	for i := 2; i >= 0; i-- {
+		if d := l.take("a"); !d.allowed || d.remaining != i {
+			t.Fatalf("request %d: %+v", 3-i, d)
+		}
+	}
+	d := l.take("a")
+	if d.allowed || d.retryAfter != 500*time.Millisecond || d.reset != 1500*time.Millisecond {
+		t.Errorf("expected to wait for the next token, got %+v", d)
+	}
+	if d := l.take("b"); !d.allowed {
+		t.Error("users must not share a bucket")
+	}
+
+	now = now.Add(time.Second)
+	if d := l.take("a"); !d.allowed || d.remaining != 1 {
+		t.Errorf("two tokens should have been refilled, got %+v", d)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(RateLimit{Rate: 1, Burst: 1})
+	l.now = func() time.Time { return now }
+	l.take("idle")
+	now = now.Add(time.Second)
+	l.take("busy")
+
+	l.sweep(now)
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("a refilled bucket should be dropped")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("an empty bucket must be kept")
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.RateLimits = map[string]RateLimit{
+		defaultRateLimit: {Rate: 1000, Burst: 1000},
+		"/gsl":           {Rate: 0.5, Burst: 1},
+	}
+	ts := newTestServer(t, cfg, Deps{})
+
+	req := func(auth string) *http.Response {
+		r, _ := http.NewRequest(http.MethodPost, ts.URL+"/gsl", nil)
+		r.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	first := token(t)
+	if resp := req(first); resp.StatusCode != http.StatusOK || resp.Header.Get("X-RateLimit-Limit") != "1" {
+		t.Fatalf("got %d %v", resp.StatusCode, resp.Header)
+	}
+	resp := req(first)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" ||
+		resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	ts.Config.Handler.ServeHTTP(rec, r)
+	if body := rec.Body.String(); !strings.Contains(body, `aide_rate_limit_decisions_total{decision="limited",route="/gsl"} 1`) {
+		t.Errorf("limited request not counted:\n%s", body)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/globbie/aide/pkg/knowdy"
+)
+
+const imgMaxAge = 24 * 60 * 60
+
+// imgHandler serves resource images by ImgId, "?w=" selects a thumbnail.
+func imgHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if shard.Resources == nil {
+			http.NotFound(w, r)
+			return
+		}
+		width := 0
+		if v := r.URL.Query().Get("w"); v != "" {
+			var err error
+			width, err = strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "invalid thumbnail width", http.StatusBadRequest)
+				return
+			}
+		}
+
+		path, err := shard.Resources.ImagePath(mux.Vars(r)["id"], width)
+		switch {
+		case errors.Is(err, knowdy.ErrBadImageId) || errors.Is(err, knowdy.ErrBadThumbWidth):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, os.ErrNotExist):
+			http.NotFound(w, r)
+			return
+		case err != nil:
+			log.Println("-- image failure:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		// trust the content, not the file name
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		contentType := http.DetectContentType(head[:n])
+		if !strings.HasPrefix(contentType, "image/") {
+			http.Error(w, "not an image", http.StatusUnsupportedMediaType)
+			return
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", contentType)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("ETag", fmt.Sprintf("\"%x-%x\"", fi.ModTime().UnixNano(), fi.Size()))
+		h.Set("Cache-Control", "public, max-age="+strconv.Itoa(imgMaxAge))
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+	})
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/globbie/aide/pkg/knowdy"
+	"github.com/globbie/aide/pkg/session"
+)
+
+const writeTimeout = 5 * time.Second
+
+// commitWait bounds how long /gsl waits for the authority to accept a
+// commit; the rest of the write timeout is left for the 202 reply.
+var commitWait = writeTimeout / 2
+
+// Server serves the AIDE HTTP API on top of a knowdy shard.
+type Server struct {
+	shard     *knowdy.Shard
+	signKey   *rsa.PrivateKey
+	verifyKey *rsa.PublicKey
+	reload    func() (*Config, Sources, error)
+	proxies   session.Proxies
+	// forwardKey authenticates requests forwarded between shards
+	forwardKey []byte
+	metrics    *serverMetrics
+	handler    http.Handler
+	http       *http.Server
+
+	mu      sync.RWMutex
+	cfg     *Config
+	sources Sources
+}
+
+// Deps are what a Server runs on besides its config.
+type Deps struct {
+	Shard     *knowdy.Shard
+	SignKey   *rsa.PrivateKey
+	VerifyKey *rsa.PublicKey
+
+	// Sources tells where the config values come from and Reload reads
+	// the config again for /admin/config; both are optional.
+	Sources Sources
+	Reload  func() (*Config, Sources, error)
+
+	// Registerer and Gatherer expose the metrics; a server gets a
+	// registry of its own when both are nil.
+	Registerer prometheus.Registerer
+	Gatherer   prometheus.Gatherer
+}
+
+// New builds the router and the middleware chain; nothing is served
+// until ListenAndServe.
+func New(cfg *Config, deps Deps) (*Server, error) {
+	switch {
+	case cfg == nil:
+		return nil, errors.New("no config")
+	case deps.Shard == nil:
+		return nil, errors.New("no shard")
+	case deps.SignKey == nil || deps.VerifyKey == nil:
+		return nil, errors.New("sign and verify keys are required")
+	case (deps.Registerer == nil) != (deps.Gatherer == nil):
+		return nil, errors.New("metrics need both a registerer and a gatherer")
+	}
+	proxies, err := session.ParseProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if deps.Registerer == nil {
+		registry := prometheus.NewRegistry()
+		deps.Registerer, deps.Gatherer = registry, registry
+	}
+
+	s := Server{
+		shard:      deps.Shard,
+		signKey:    deps.SignKey,
+		verifyKey:  deps.VerifyKey,
+		reload:     deps.Reload,
+		proxies:    proxies,
+		forwardKey: forwardKey(deps.SignKey),
+		metrics:    newServerMetrics(),
+		cfg:        cfg,
+		sources:    deps.Sources,
+	}
+	if s.sources == nil {
+		s.sources = make(Sources)
+	}
+	if err := s.metrics.register(deps.Registerer); err != nil {
+		return nil, fmt.Errorf("could not register metrics: %w", err)
+	}
+	if err := registerDecodeCacheMetrics(deps.Registerer, s.shard.DecodeCache); err != nil {
+		return nil, fmt.Errorf("could not register metrics: %w", err)
+	}
+	observer, err := registerPoolMetrics(deps.Registerer, s.shard)
+	if err != nil {
+		return nil, fmt.Errorf("could not register metrics: %w", err)
+	}
+	s.shard.Observer = observer
+
+	s.handler = logger(s.routes(deps.Gatherer))
+	s.http = &http.Server{
+		Handler:      s.handler,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  15 * time.Second,
+		Addr:         cfg.ListenAddress,
+	}
+	return &s, nil
+}
+
+func (s *Server) routes(gatherer prometheus.Gatherer) http.Handler {
+	shard := s.shard
+	router := mux.NewRouter()
+	router.Handle("/session", s.rateLimit("/session", s.measurer(s.limiter(s.sessionHandler()))))
+	routed := s.shardRouting()
+	router.Handle("/query", s.optionalAuthorization(s.rateLimit("/query", routed(s.measurer(s.limiter(queryHandler(shard)))))))
+	router.Handle("/gsl", s.authorization(s.rateLimit("/gsl", routed(s.measurer(s.limiter(gslHandler(shard)))))))
+	router.Handle("/msg", s.authorization(s.rateLimit("/msg", routed(s.measurer(s.limiter(msgHandler(shard)))))))
+	router.Handle("/text/encode", s.authorization(s.rateLimit("/text/encode", s.measurer(s.limiter(textEncodeHandler(shard))))))
+	router.Handle("/geo/nearby", s.rateLimit("/geo/nearby", s.measurer(s.limiter(geoNearbyHandler(shard)))))
+	router.Handle("/img/{id}", imgHandler(shard))
+	router.Handle("/metrics", metricsHandler(gatherer))
+	router.Handle("/healthz", healthzHandler())
+	router.Handle("/readyz", readyzHandler(shard))
+	s.registerAdminRoutes(router)
+
+	spa := spaHandler{
+		staticPath: func() string { return s.Config().StaticPath },
+		indexPath:  "index.html",
+	}
+	router.PathPrefix("/").Handler(spa)
+	return router
+}
+
+// Handler is the full middleware chain, e.g. for httptest.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Config is the config in effect; it is replaced, never modified, on
+// reload.
+func (s *Server) Config() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+// ListenAndServe polls the peer shards and serves on the listen address
+// until Shutdown.
+func (s *Server) ListenAndServe() error {
+	ctx, stopPolling := context.WithCancel(context.Background())
+	defer stopPolling()
+	go s.shard.PeerShards.Run(ctx)
+	return s.http.ListenAndServe()
+}
+
+// Shutdown waits for the requests in progress, then drains the shard.
+// The shard must not be deleted when an error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.http.SetKeepAlivesEnabled(false)
+	if err := s.http.Shutdown(ctx); err != nil {
+		log.Println("-- failed to gracefully shutdown the server:", s.http.Addr, err)
+	}
+	// then for tasks started outside of requests and for commit forwards
+	return s.shard.Drain(ctx)
+}
+
+// NewShard builds the shard with its ling processor and resources.
+func NewShard(cfg *Config) (*knowdy.Shard, error) {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	opts := knowdy.ShardOptions{
+		DefaultLang:      cfg.DefaultLang,
+		PlacementShards:  cfg.PlacementShards,
+		PollInterval:     cfg.ShardPollInterval,
+		CommitOutboxPath: cfg.CommitOutboxPath,
+		DecodeCacheSize:  cfg.DecodeCacheSize,
+		DecodeCacheTTL:   cfg.DecodeCacheTTL,
+		MaxWorkers:       cfg.MaxWorkers,
+	}
+
+	kndConfig, err := ioutil.ReadFile(cfg.KndConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read shard config: %w", err)
+	}
+	shard, err := knowdy.New(string(kndConfig), cfg.KnowdyAddress, cfg.KnowdyServiceName, cfg.LingProcAddress,
+		cfg.ServiceDomain, cfg.KnowdyShards, workers, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not create a Knowdy Shard: %w", err)
+	}
+	shard.Name = cfg.ShardName
+
+	shard.LingProc, err = knowdy.NewLingProcessor(cfg.LingProc, cfg.LingProcAddress,
+		cfg.LingSchemaPath, cfg.LingFixturePath)
+	if err != nil {
+		shard.Del()
+		return nil, fmt.Errorf("could not set up the linguistic processor: %w", err)
+	}
+	if cfg.ResourcePath != "" {
+		shard.Resources, err = knowdy.NewResourceStore(cfg.ResourcePath)
+		if err != nil {
+			shard.Del()
+			return nil, fmt.Errorf("could not load the resource catalogue: %w", err)
+		}
+	}
+	return shard, nil
+}
+
+// LoadKeys reads the token keys named in the config.
+func LoadKeys(cfg *Config) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	signKeyBytes, err := ioutil.ReadFile(cfg.SignKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read sign key: %w", err)
+	}
+	signKey, err := jwt.ParseRSAPrivateKeyFromPEM(signKeyBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse sign key: %w", err)
+	}
+	verifyBytes, err := ioutil.ReadFile(cfg.VerifyKeyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read verify key file('%v'): %w", cfg.VerifyKeyPath, err)
+	}
+	verifyKey, err := jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse verify key: %w", err)
+	}
+	return signKey, verifyKey, nil
+}
+
+// spaHandler serves the static path of the current config.
+type spaHandler struct {
+	staticPath func() string
+	indexPath  string
+}
+
+func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// get the absolute path to prevent directory traversal
+	path, err := filepath.Abs(r.URL.Path)
+	if err != nil {
+		// if we failed to get the absolute path respond with a 400 bad request
+		// and stop
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// prepend the path with the path to the static directory
+	staticPath := h.staticPath()
+	path = filepath.Join(staticPath, path)
+
+	// check whether a file exists at the given path
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		// log.Println("dynamic resource:" + path)
+
+		// file does not exist, serve index.html
+		http.ServeFile(w, r, filepath.Join(staticPath, h.indexPath))
+		return
+	} else if err != nil {
+		// if we got an error (that wasn't that the file doesn't exist) stating the
+		// file, return a 500 internal server error and stop
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// otherwise, use http.FileServer to serve the static dir
+	http.FileServer(http.Dir(staticPath)).ServeHTTP(w, r)
+}
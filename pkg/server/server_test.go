@@ -0,0 +1,280 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/globbie/aide/pkg/knowdy"
+	"github.com/globbie/aide/pkg/session"
+)
+
+const shardCfg = `
+{schema knd
+	{db-path .}
+	{schema-path ../knowdy/testdata/system-schemas
+		{user User
+			{base-repo shared-repo
+				{schema-path ../knowdy/testdata/shared-schemas}
+			}
+		}
+	}
+}
+`
+
+var testKey *rsa.PrivateKey
+
+func signKey(t *testing.T) *rsa.PrivateKey {
+	if testKey == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testKey = key
+	}
+	return testKey
+}
+
+func newTestConfig() *Config {
+	return &Config{
+		ListenAddress:     "127.0.0.1:0",
+		KnowdyServiceName: "knowdy",
+		KnowdyShards:      []string{"public"},
+		MailServerAuth:    "secret",
+		RequestsMax:       4,
+		SlotAwaitDuration: time.Second,
+	}
+}
+
+func newTestServer(t *testing.T, cfg *Config, deps Deps) *httptest.Server {
+	dir := t.TempDir()
+	savedScripts, savedMsgs := knowdy.DBCacheFilename, knowdy.MsgCacheFilename
+	knowdy.DBCacheFilename = filepath.Join(dir, "dbcache.json")
+	knowdy.MsgCacheFilename = filepath.Join(dir, "msgcache.json")
+	t.Cleanup(func() { knowdy.DBCacheFilename, knowdy.MsgCacheFilename = savedScripts, savedMsgs })
+
+	authority := cfg.KnowdyAddress
+	if authority == "" {
+		authority = "localhost:8081"
+	}
+	opts := knowdy.ShardOptions{CommitOutboxPath: cfg.CommitOutboxPath}
+	shard, err := knowdy.New(shardCfg, authority, "knowdy", "localhost:8069", "localhost", cfg.KnowdyShards, 2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shard.Del() })
+
+	key := signKey(t)
+	deps.Shard, deps.SignKey, deps.VerifyKey = shard, key, &key.PublicKey
+	s, err := New(cfg, deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func token(t *testing.T, roles ...string) string {
+	claims := jwt.MapClaims{
+		"uid":   "42",
+		"shard": "",
+		"exp":   float64(time.Now().Add(time.Hour).Unix()),
+		"roles": roles,
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(signKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + signed
+}
+
+func do(t *testing.T, method string, url string, auth string, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestServerAuthorization(t *testing.T) {
+	ts := newTestServer(t, newTestConfig(), Deps{})
+
+	if status, _ := do(t, http.MethodGet, ts.URL+"/healthz", "", ""); status != http.StatusOK {
+		t.Errorf("healthz replied %d", status)
+	}
+	if status, _ := do(t, http.MethodPost, ts.URL+"/gsl", "", "{task}"); status != http.StatusUnauthorized {
+		t.Errorf("a request without a token got %d", status)
+	}
+	if status, _ := do(t, http.MethodPost, ts.URL+"/text/encode", "", "{!concept}"); status != http.StatusUnauthorized {
+		t.Errorf("a text encode request without a token got %d", status)
+	}
+	if status, body := do(t, http.MethodPost, ts.URL+"/gsl", token(t), "{task}"); status != http.StatusOK {
+		t.Errorf("an authorized request got %d: %s", status, body)
+	}
+	if status, _ := do(t, http.MethodGet, ts.URL+"/admin/config", token(t), ""); status != http.StatusForbidden {
+		t.Errorf("a non-admin got %d from the admin API", status)
+	}
+}
+
+func TestServerCommitPending(t *testing.T) {
+	// an authority that never answers
+	authority := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(authority.Close)
+
+	savedWait := commitWait
+	commitWait = 200 * time.Millisecond
+	t.Cleanup(func() { commitWait = savedWait })
+
+	cfg := newTestConfig()
+	cfg.KnowdyAddress = authority.Listener.Addr().String()
+	cfg.CommitOutboxPath = filepath.Join(t.TempDir(), "commits.wal")
+	ts := newTestServer(t, cfg, Deps{})
+
+	start := time.Now()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/gsl", strings.NewReader("{task{class User{!inst _}}}"))
+	req.Header.Set("Authorization", token(t))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || !strings.Contains(string(body), `"status":"pending"`) {
+		t.Errorf("got %d: %s", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed > writeTimeout/2 {
+		t.Errorf("the reply took %v", elapsed)
+	}
+	// the next reads of the client go to the authority, whichever replica serves them
+	if resp.Header.Get(session.LastCommitHeader) == "" {
+		t.Error("no last commit marker")
+	}
+}
+
+func TestServerConfigReload(t *testing.T) {
+	cfg := newTestConfig()
+	reloaded := *cfg
+	reloaded.RequestsMax = 8
+	reloaded.KnowdyShards = []string{"public", "secure"}
+	reloaded.ListenAddress = "127.0.0.1:1"
+	ts := newTestServer(t, cfg, Deps{
+		Sources: Sources{"requests-max": SourceFile},
+		Reload: func() (*Config, Sources, error) {
+			return &reloaded, Sources{"requests-max": SourceEnv}, nil
+		},
+	})
+	admin := token(t, "admin")
+
+	status, body := do(t, http.MethodGet, ts.URL+"/admin/config", admin, "")
+	var values map[string]configValue
+	if err := json.Unmarshal([]byte(body), &values); err != nil || status != http.StatusOK {
+		t.Fatalf("got %d %q", status, body)
+	}
+	if values["mail-server-auth"].Value != redacted {
+		t.Errorf("secret not redacted: %v", values["mail-server-auth"])
+	}
+	if v := values["requests-max"]; v.Source != SourceFile || !v.Reloadable {
+		t.Errorf("unexpected requests-max %+v", v)
+	}
+
+	status, body = do(t, http.MethodPost, ts.URL+"/admin/config/reload", admin, "")
+	var result configReload
+	if err := json.Unmarshal([]byte(body), &result); err != nil || status != http.StatusOK {
+		t.Fatalf("got %d %q", status, body)
+	}
+	if strings.Join(result.Reloaded, ",") != "knowdy-shards,requests-max" ||
+		strings.Join(result.RestartRequired, ",") != "listen-address" {
+		t.Errorf("unexpected reload %+v", result)
+	}
+
+	_, body = do(t, http.MethodGet, ts.URL+"/admin/shards", admin, "")
+	if !strings.Contains(body, "knowdy-secure") {
+		t.Errorf("peer shards not reloaded: %s", body)
+	}
+}
+
+func TestServerConfigReloadFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "aide.json")
+	for _, name := range []string{"shard.gsl", "key.rsa", "key.rsa.pub"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig := func(extra string) {
+		data := `{"listen-address":"localhost:0","ling-service-name":"localhost:8069",` +
+			`"knowdy-service-name":"knowdy","knowdy-shards":["public"],` + extra +
+			`"shard-config":"` + filepath.Join(dir, "shard.gsl") + `",` +
+			`"sign-key-path":"` + filepath.Join(dir, "key.rsa") + `",` +
+			`"verify-key-path":"` + filepath.Join(dir, "key.rsa.pub") + `"}`
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("")
+	cfg, sources, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RequestsMax != 10 || cfg.SlotAwaitDuration != time.Second || sources["requests-max"] != SourceDefault {
+		t.Fatalf("unexpected defaults %d %v %s", cfg.RequestsMax, cfg.SlotAwaitDuration, sources["requests-max"])
+	}
+	ts := newTestServer(t, cfg, Deps{
+		Sources: sources,
+		Reload:  func() (*Config, Sources, error) { return LoadConfig(path) },
+	})
+	admin := token(t, "admin")
+
+	writeConfig(`"requests-max":20,`)
+	status, body := do(t, http.MethodPost, ts.URL+"/admin/config/reload", admin, "")
+	var result configReload
+	if err := json.Unmarshal([]byte(body), &result); err != nil || status != http.StatusOK {
+		t.Fatalf("got %d %q", status, body)
+	}
+	if strings.Join(result.Reloaded, ",") != "requests-max" {
+		t.Errorf("unexpected reload %+v", result)
+	}
+	_, body = do(t, http.MethodGet, ts.URL+"/admin/config", admin, "")
+	var values map[string]configValue
+	if err := json.Unmarshal([]byte(body), &values); err != nil {
+		t.Fatal(err)
+	}
+	if v := values["requests-max"]; v.Value != 20.0 || v.Source != SourceFile {
+		t.Errorf("unexpected requests-max %+v", v)
+	}
+}
+
+func TestServerInstances(t *testing.T) {
+	first := newTestServer(t, newTestConfig(), Deps{})
+	second := newTestServer(t, newTestConfig(), Deps{})
+
+	for _, ts := range []*httptest.Server{first, second} {
+		status, body := do(t, http.MethodGet, ts.URL+"/metrics", "", "")
+		if status != http.StatusOK || !strings.Contains(body, "aide_workers 2") {
+			t.Errorf("%s: unexpected metrics %d", ts.URL, status)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/globbie/aide/pkg/knowdy"
+	"github.com/globbie/aide/pkg/session"
+)
+
+// forwardedHeader marks requests proxied by a peer so that they are
+// served locally instead of bouncing between instances. Its value is the
+// sending shard and a MAC binding it to the client token, so that a
+// client cannot skip routing by sending the header itself.
+const forwardedHeader = "X-Aide-Forwarded-By"
+
+// forwardKey derives the MAC key of forwarded requests from the sign key
+// that every shard shares to verify the tokens of the others.
+func forwardKey(signKey *rsa.PrivateKey) []byte {
+	sum := sha256.Sum256(append([]byte("aide-forward\n"), x509.MarshalPKCS1PrivateKey(signKey)...))
+	return sum[:]
+}
+
+func forwardMAC(key []byte, from string, r *http.Request) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(from + "\n" + r.Header.Get("Authorization")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// forwardedByPeer checks and removes the forwarded header: it holds only
+// when the MAC is valid and names a registered peer.
+func (s *Server) forwardedByPeer(r *http.Request) bool {
+	v := r.Header.Get(forwardedHeader)
+	if v == "" {
+		return false
+	}
+	r.Header.Del(forwardedHeader)
+	fields := strings.Fields(v)
+	if len(fields) != 2 {
+		return false
+	}
+	from, sum := fields[0], fields[1]
+	if !hmac.Equal([]byte(sum), []byte(forwardMAC(s.forwardKey, from, r))) {
+		return false
+	}
+	_, err := s.shard.PeerShards.Route(from)
+	return !errors.Is(err, knowdy.ErrUnknownShard)
+}
+
+// shardProxies keeps a reverse proxy per peer address.
+type shardProxies struct {
+	local string
+	key   []byte
+	mu    sync.Mutex
+	peers map[string]*httputil.ReverseProxy
+}
+
+func (p *shardProxies) get(address string) *httputil.ReverseProxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if proxy, ok := p.peers[address]; ok {
+		return proxy
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = address
+			r.Header.Set(forwardedHeader, p.local+" "+forwardMAC(p.key, p.local, r))
+		},
+		// stream replies as they come
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Println("-- failed to forward", r.URL.Path, "to", address, ":", err)
+			http.Error(w, "{\"error\":\"shard is unavailable\"}", http.StatusBadGateway)
+		},
+	}
+	p.peers[address] = proxy
+	return proxy
+}
+
+// shardRouting serves requests of the local shard and forwards the rest
+// to the peer named in the token; it goes after authorization. Requests
+// naming an unknown shard or a shard that is down are refused.
+func (s *Server) shardRouting() func(http.Handler) http.Handler {
+	shard := s.shard
+	proxies := &shardProxies{local: shard.Name, key: s.forwardKey, peers: make(map[string]*httputil.ReverseProxy)}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwarded := s.forwardedByPeer(r)
+			ses, ok := r.Context().Value("session").(*session.ChatSession)
+			if !ok || ses.ShardId == shard.Name || forwarded {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if shard.Name == "" {
+				// a standalone instance serves every shard itself
+				h.ServeHTTP(w, r)
+				return
+			}
+			si, err := shard.PeerShards.Route(ses.ShardId)
+			switch {
+			case errors.Is(err, knowdy.ErrUnknownShard):
+				http.Error(w, "{\"error\":\"unknown shard\"}", http.StatusUnauthorized)
+				return
+			case errors.Is(err, knowdy.ErrShardDown):
+				w.Header().Set("Retry-After", strconv.Itoa(int(shard.PeerShards.PollInterval.Seconds())))
+				http.Error(w, "{\"error\":\"shard is unavailable\"}", http.StatusServiceUnavailable)
+				return
+			}
+			proxies.get(si.Address).ServeHTTP(w, r)
+		})
+	}
+}
+
+func shardsHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, shard.PeerShards.List())
+	})
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/globbie/aide/pkg/knowdy"
+	"github.com/globbie/aide/pkg/session"
+)
+
+func TestShardRouting(t *testing.T) {
+	var peerHeader string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerHeader = r.Header.Get(forwardedHeader)
+		_, _ = w.Write([]byte("peer"))
+	}))
+	defer peer.Close()
+
+	key := signKey(t)
+	s := &Server{
+		shard: &knowdy.Shard{
+			Name: "default",
+			PeerShards: knowdy.NewShardRegistry([]knowdy.ShardInfo{
+				{Name: "default", Address: "localhost:1", Healthy: true},
+				{Name: "public", Address: peer.Listener.Addr().String(), Healthy: true},
+			}),
+		},
+		forwardKey: forwardKey(key),
+	}
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("local"))
+	})
+	routed := s.shardRouting()(local)
+
+	serve := func(shardId string, forwardedBy string) string {
+		return serveAs(routed, shardId, forwardedBy)
+	}
+	if got := serve("default", ""); got != "local" {
+		t.Errorf("local shard: got %q", got)
+	}
+	if got := serve("public", ""); got != "peer" {
+		t.Errorf("peer shard: got %q", got)
+	}
+
+	// the header sent by the peer is accepted back, but not by another client
+	valid := peerHeader
+	if got := serve("public", valid); got != "local" {
+		t.Errorf("forwarded by a peer: got %q", got)
+	}
+	for _, forged := range []string{"public", "public " + valid[len("default "):], "default deadbeef"} {
+		peerHeader = ""
+		if got := serve("public", forged); got != "peer" {
+			t.Errorf("forged header %q skipped routing: got %q", forged, got)
+		}
+		if peerHeader != valid {
+			t.Errorf("forged header %q reached the peer as %q", forged, peerHeader)
+		}
+	}
+
+	// a standalone instance serves every shard itself
+	s.shard.Name = ""
+	if got := serveAs(s.shardRouting()(local), "unknown", ""); got != "local" {
+		t.Errorf("standalone: got %q", got)
+	}
+}
+
+func serveAs(h http.Handler, shardId string, forwardedBy string) string {
+	r := httptest.NewRequest(http.MethodGet, "/msg", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	if forwardedBy != "" {
+		r.Header.Set(forwardedHeader, forwardedBy)
+	}
+	ses := &session.ChatSession{ShardId: shardId}
+	r = r.WithContext(context.WithValue(r.Context(), "session", ses))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Body.String()
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/language"
+
+	"github.com/globbie/aide/pkg/knowdy"
+	"github.com/globbie/aide/pkg/session"
+)
+
+const maxGraphSize = 1 << 16
+
+// requestLang prefers the lang URL param over Accept-Language, then def.
+func requestLang(r *http.Request, def string) string {
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		return lang
+	}
+	langs, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if len(langs) == 0 {
+		return def
+	}
+	base, _ := langs[0].Base()
+	return base.String()
+}
+
+// writeLingError maps ling-proc failures onto HTTP statuses: bad graphs
+// are the client's fault, a failing or unreachable service is not.
+func writeLingError(w http.ResponseWriter, err error) {
+	log.Println("-- text encoding failed:", err)
+	status := http.StatusBadGateway
+	var gerr *knowdy.GlottieError
+	switch {
+	case errors.Is(err, knowdy.ErrEmptyGraph), errors.Is(err, knowdy.ErrNoInterp),
+		errors.Is(err, knowdy.ErrNoFixture):
+		status = http.StatusUnprocessableEntity
+	case errors.As(err, &gerr) && gerr.StatusCode < 500:
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, knowdy.ErrCircuitOpen):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// textEncodeHandler renders a posted GSL graph as text.
+func textEncodeHandler(shard *knowdy.Shard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		defer r.Body.Close()
+		graph, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxGraphSize))
+		if err != nil {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "graph is too large"})
+			return
+		}
+		if strings.TrimSpace(string(graph)) == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "graph is missing"})
+			return
+		}
+		lang := requestLang(r, shard.DefaultLang)
+		text, err := shard.EncodeText(r.Context(), string(graph), lang)
+		if err != nil {
+			writeLingError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"text": text, "lang": lang})
+	})
+}
+
+// queryTextReply answers a /query?format=text request with the result
+// graph and its rendering.
+func queryTextReply(w http.ResponseWriter, r *http.Request, shard *knowdy.Shard, gsl string, lang string) {
+	task := knowdy.QueryTask(gsl, lang, "GSL")
+	ses, _ := r.Context().Value("session").(*session.ChatSession)
+	graph, err := shard.ReadTask(r.Context(), ses, task)
+	if err != nil {
+		log.Println(graph)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": graph})
+		return
+	}
+	text, err := shard.EncodeText(r.Context(), graph, lang)
+	if err != nil {
+		writeLingError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"graph": graph, "text": text, "lang": lang})
+}
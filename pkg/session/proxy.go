@@ -0,0 +1,143 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var ErrNoIP = errors.New("no valid IP found")
+
+// Proxies are the CIDRs of the proxies whose forwarding headers are
+// believed. Headers from any other peer are ignored.
+type Proxies []*net.IPNet
+
+// ParseProxies reads trusted proxy CIDRs; plain IPs are taken as single
+// hosts.
+func ParseProxies(cidrs []string) (Proxies, error) {
+	var proxies Proxies
+	for _, cidr := range cidrs {
+		ipNet, err := ParseProxy(cidr)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+// ParseProxy reads a trusted proxy CIDR or IP.
+func ParseProxy(cidr string) (*net.IPNet, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid proxy address %q", cidr)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy CIDR %q", cidr)
+	}
+	return ipNet, nil
+}
+
+// Trusted tells whether ip is one of the proxies.
+func (p Proxies) Trusted(ip net.IP) bool {
+	for _, ipNet := range p {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSessionIP returns the client IP. Forwarding headers are only read
+// when the peer is one of the trusted proxies: the hops of Forwarded, or else of
+// X-Forwarded-For, are walked from the right skipping trusted proxies,
+// and X-Real-IP is the last resort.
+func GetSessionIP(r *http.Request, proxies Proxies) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	peer := net.ParseIP(host)
+	if peer == nil {
+		return "", ErrNoIP
+	}
+	if !proxies.Trusted(peer) {
+		return peer.String(), nil
+	}
+
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		return clientIP(proxies, peer, forwardedHops(values)), nil
+	}
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		var hops []string
+		for _, value := range values {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+		return clientIP(proxies, peer, hops), nil
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String(), nil
+	}
+	return peer.String(), nil
+}
+
+// clientIP walks the hops from the right: the first one that is not a
+// trusted proxy is the client. A hop that is not an IP cannot be
+// trusted, so the walk stops at the hop before it.
+func clientIP(proxies Proxies, peer net.IP, hops []string) string {
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !proxies.Trusted(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// parseHop reads an address of X-Forwarded-For or a for= node of
+// Forwarded, which may carry a port: 192.0.2.1:8080, "[2001:db8::1]:80".
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+}
+
+// forwardedHops lists the for= nodes of RFC 7239 Forwarded headers in
+// order; an element without one counts as an unknown hop.
+func forwardedHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := "unknown"
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hop = kv[1]
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
@@ -0,0 +1,56 @@
+package session
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetSessionIP(t *testing.T) {
+	proxies, err := ParseProxies([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"no headers", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"spoofed by an untrusted peer", "203.0.113.9:1234",
+			map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Real-IP": "1.2.3.4", "Forwarded": "for=1.2.3.4"},
+			"203.0.113.9"},
+		{"rightmost untrusted hop", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.3, 192.0.2.7"}, "198.51.100.3"},
+		{"all hops trusted", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "10.1.1.1, 10.2.2.2"}, "10.1.1.1"},
+		{"garbage hop", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "1.2.3.4, nonsense, 10.2.2.2"}, "10.2.2.2"},
+		{"forwarded wins", "10.0.0.1:1234",
+			map[string]string{"Forwarded": `for=198.51.100.3;proto=https, for="[2001:db8::1]:443"`, "X-Forwarded-For": "1.2.3.4"},
+			"198.51.100.3"},
+		{"forwarded unknown hop", "10.0.0.1:1234",
+			map[string]string{"Forwarded": "for=198.51.100.3, for=_hidden"}, "10.0.0.1"},
+		{"real ip", "10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.3"}, "198.51.100.3"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got, err := GetSessionIP(r, proxies); err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseProxies(t *testing.T) {
+	if _, err := ParseProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an invalid CIDR to be rejected")
+	}
+	if _, err := ParseProxies([]string{"proxy.local"}); err == nil {
+		t.Error("expected a host name to be rejected")
+	}
+}
@@ -1,11 +1,9 @@
 package session
 
 import (
-	"errors"
 	"crypto/rsa"
-	"net"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -16,6 +14,11 @@ type ChatThread struct {
 	ThreadId     string
 }
 
+type Location struct {
+	Lat         float64
+	Lng         float64
+}
+
 type ChatSession struct {
 	UserId      string
 	ShardId     string
@@ -24,8 +27,17 @@ type ChatSession struct {
 	Langs       []language.Tag
 	Roles       []string
 	Threads     []ChatThread
+	Location    *Location
+	LastCommit  time.Time
 }
 
+// The time of the last commit of a client travels with the client, so
+// that whichever replica serves its next reads knows about the commit.
+const (
+	LastCommitCookie = "last-commit"
+	LastCommitHeader = "X-Aide-Last-Commit"
+)
+
 type Claims struct {
 	*jwt.StandardClaims
 	UserId    string   `json:"uid,required"`
@@ -33,19 +45,77 @@ type Claims struct {
 	UserRoles []string `json:"roles,omitempty"`
 }
 
-func New(r *http.Request) (*ChatSession, error) {
+// New reads a session from the request; forwarding headers are believed
+// only from the given proxies.
+func New(r *http.Request, proxies Proxies) (*ChatSession, error) {
 	cs := ChatSession{
 		UserAgent: r.UserAgent(),
 	}
-	ip, err := GetSessionIP(r)
+	ip, err := GetSessionIP(r, proxies)
 	if err == nil {
 		cs.UserIP = ip
 	}
 	cs.Langs, _, _ = language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	cs.LastCommit = lastCommit(r)
 	
 	return &cs, nil
 }
 
+// lastCommit reads the marker from the header, or else from the cookie;
+// it is a Unix time in milliseconds.
+func lastCommit(r *http.Request) time.Time {
+	v := r.Header.Get(LastCommitHeader)
+	if v == "" {
+		if cookie, err := r.Cookie(LastCommitCookie); err == nil {
+			v = cookie.Value
+		}
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// SetLastCommit hands the marker of a commit made at the given time to the
+// client, both as a header and as a cookie living for ttl.
+func SetLastCommit(w http.ResponseWriter, at time.Time, domain string, ttl time.Duration) {
+	v := strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)
+	w.Header().Set(LastCommitHeader, v)
+	cookie, _ := BuildSessionCookie(LastCommitCookie, v, domain)
+	cookie.Expires = at.Add(ttl)
+	http.SetCookie(w, cookie)
+}
+
+func (cs *ChatSession) HasRole(role string) bool {
+	for _, r := range cs.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// LangChain lists the base languages of the session in order of
+// preference, deduplicated and terminated by the given default language.
+func (cs *ChatSession) LangChain(def string) []string {
+	var chain []string
+	seen := make(map[string]bool)
+	for _, tag := range cs.Langs {
+		base, _ := tag.Base()
+		lang := base.String()
+		if lang == "und" || seen[lang] {
+			continue
+		}
+		seen[lang] = true
+		chain = append(chain, lang)
+	}
+	if def != "" && !seen[def] {
+		chain = append(chain, def)
+	}
+	return chain
+}
+
 func BuildSessionCookie(name string, val string, domain string) (*http.Cookie, error) {
 	cookie := http.Cookie{}
 	cookie.Name = name
@@ -60,31 +130,6 @@ func BuildSessionCookie(name string, val string, domain string) (*http.Cookie, e
 	return &cookie, nil
 }
 
-func GetSessionIP(r *http.Request) (string, error) {
-    ip := r.Header.Get("X-REAL-IP")
-    netIP := net.ParseIP(ip)
-    if netIP != nil {
-        return ip, nil
-    }
-    ips := r.Header.Get("X-FORWARDED-FOR")
-    splitIps := strings.Split(ips, ",")
-    for _, ip := range splitIps {
-        netIP := net.ParseIP(ip)
-        if netIP != nil {
-            return ip, nil
-        }
-    }
-    ip, _, err := net.SplitHostPort(r.RemoteAddr)
-    if err != nil {
-        return "", err
-    }
-    netIP = net.ParseIP(ip)
-    if netIP != nil {
-        return ip, nil
-    }
-    return "", errors.New("No valid IP found")
-}
-
 func IssueAccessToken(ses *ChatSession, signKey *rsa.PrivateKey, expiry int) (string, error) {
 	token := jwt.New(jwt.GetSigningMethod("RS256"))
 	token.Claims = &Claims{
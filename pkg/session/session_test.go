@@ -0,0 +1,35 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLastCommit(t *testing.T) {
+	at := time.Unix(1700000000, 123000000)
+	w := httptest.NewRecorder()
+	SetLastCommit(w, at, "localhost", time.Minute)
+	resp := w.Result()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range resp.Cookies() {
+		r.AddCookie(cookie)
+	}
+	if ses, _ := New(r, nil); !ses.LastCommit.Equal(at) {
+		t.Errorf("cookie: got %v, want %v", ses.LastCommit, at)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(LastCommitHeader, resp.Header.Get(LastCommitHeader))
+	if ses, _ := New(r, nil); !ses.LastCommit.Equal(at) {
+		t.Errorf("header: got %v, want %v", ses.LastCommit, at)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(LastCommitHeader, "yesterday")
+	if ses, _ := New(r, nil); !ses.LastCommit.IsZero() {
+		t.Errorf("garbage: got %v", ses.LastCommit)
+	}
+}